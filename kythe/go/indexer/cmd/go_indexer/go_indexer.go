@@ -43,16 +43,44 @@ import (
 )
 
 var (
-	doIndexPack = flag.Bool("indexpack", false, "Treat arguments as index pack directories")
-	doZipPack   = flag.Bool("zip", false, "Treat arguments as zipped indexpack files (implies -indexpack)")
-	doJSON      = flag.Bool("json", false, "Write output as JSON")
-	doLibNodes  = flag.Bool("libnodes", false, "Emit nodes for standard library packages")
-	doCodeFacts = flag.Bool("code", false, "Emit code facts containing MarkedSource markup")
-	metaSuffix  = flag.String("meta", "", "If set, treat files with this suffix as JSON linkage metadata")
-	docBase     = flag.String("docbase", "http://godoc.org", "If set, use as the base URL for godoc links")
+	doIndexPack   = flag.Bool("indexpack", false, "Treat arguments as index pack directories")
+	doZipPack     = flag.Bool("zip", false, "Treat arguments as zipped indexpack files (implies -indexpack)")
+	doJSON        = flag.Bool("json", false, "Write output as JSON")
+	doLibNodes    = flag.Bool("libnodes", false, "Emit nodes for standard library packages")
+	doCodeFacts   = flag.Bool("code", false, "Emit code facts containing MarkedSource markup")
+	doComplexity  = flag.Bool("complexity", false, "Emit facts recording the cyclomatic complexity of functions")
+	doDigests     = flag.Bool("digests", false, "Emit facts recording the SHA-256 digest of each source file")
+	doImpls       = flag.Bool("impls", false, "Emit edges from interface methods to the concrete methods that implement them")
+	doMethIfaces  = flag.Bool("methodifaces", false, "Emit edges from concrete methods to the interfaces they help their receiver types satisfy")
+	doErrResults  = flag.Bool("errresults", false, "Emit facts marking functions whose last result is an error")
+	doArity       = flag.Bool("arity", false, "Emit facts recording the numbers of parameters and results of functions")
+	doCoverage    = flag.Bool("coverage", false, "Emit facts marking functions as coverage targets, with the ranges of lines they span")
+	doInitOrder   = flag.Bool("initorder", false, "Emit ordered edges recording the initialization order of package-level variables")
+	doInitValues  = flag.Bool("initvalues", false, "Blame references to function values in package-level initializers on the package initializer")
+	doAPIOnly     = flag.Bool("apionly", false, "Emit only the API declarations of each package, skipping function bodies")
+	doSkipGen     = flag.Bool("skipgenerated", false, "Do not emit anchors for files marked as generated code")
+	doTodos       = flag.Bool("todos", false, "Emit diagnostic nodes for TODO, FIXME, and BUG markers in comments")
+	doPkgUses     = flag.Bool("pkguses", false, "Emit edges from functions to the imported packages they refer to")
+	doPromotions  = flag.Bool("promotions", false, "Emit edges from struct types to the methods they promote from embedded interfaces")
+	doMethodSets  = flag.Bool("methodsets", false, "Emit edges from interface types to their flattened method sets and from each method to its declaring interface")
+	doErrMatches  = flag.Bool("errormatches", false, "Emit edges from calls to errors.As to the types of error they match")
+	doSpreads     = flag.Bool("spreads", false, "Emit edges from arguments spread into variadic calls to the variadic parameters")
+	doIndexes     = flag.Bool("indexaccess", false, "Emit edges marking element reads and writes of indexed maps, slices, and arrays")
+	doRunes       = flag.Bool("runeoffsets", false, "Emit facts giving the offsets of anchors in runes as well as bytes")
+	doResults     = flag.Bool("resultassigns", false, "Emit edges from returned expressions to the named results they are assigned to")
+	doPlaceholder = flag.Bool("placeholders", false, "Emit placeholder package nodes for imports that cannot be resolved")
+	doKeywords    = flag.Bool("keywords", false, "Emit anchors for func, type, return, and range keywords")
+	doAsserted    = flag.Bool("asserted", false, "Emit edges for interface satisfactions asserted by package-level blank variables")
+	metaSuffix    = flag.String("meta", "", "If set, treat files with this suffix as JSON linkage metadata")
+	doNoDocs      = flag.Bool("nodocs", false, "Do not emit doc nodes for documentation comments")
+	docBase       = flag.String("docbase", "http://godoc.org", "If set, use as the base URL for godoc links")
+	docFormatName = flag.String("docformat", "kythe", "Format of documentation text: kythe (escaped per the Kythe schema), raw, or markdown")
+	anchorsName   = flag.String("anchors", "offset", "Scheme for anchor vnames: offset (keyed by byte offsets) or stable (keyed by the spanned text and its occurrence in the file)")
 
 	writeEntry func(context.Context, *spb.Entry) error
 	docURL     *url.URL
+	docFormat  indexer.DocFormat
+	anchors    indexer.AnchorScheme
 )
 
 func init() {
@@ -101,6 +129,24 @@ func main() {
 		}
 		docURL = u
 	}
+	switch *docFormatName {
+	case "kythe":
+		docFormat = indexer.KytheEscaped
+	case "raw":
+		docFormat = indexer.Raw
+	case "markdown":
+		docFormat = indexer.Markdown
+	default:
+		log.Fatalf("Unknown doc format %q", *docFormatName)
+	}
+	switch *anchorsName {
+	case "offset":
+		anchors = indexer.OffsetAnchors
+	case "stable":
+		anchors = indexer.StableAnchors
+	default:
+		log.Fatalf("Unknown anchor scheme %q", *anchorsName)
+	}
 
 	ctx := context.Background()
 	for _, path := range flag.Args() {
@@ -141,10 +187,37 @@ func indexGo(ctx context.Context, unit *apb.CompilationUnit, f indexer.Fetcher)
 	}
 	log.Printf("Finished resolving compilation: %s", pi.String())
 	return pi.Emit(ctx, writeEntry, &indexer.EmitOptions{
-		EmitStandardLibs: *doLibNodes,
-		EmitMarkedSource: *doCodeFacts,
-		EmitLinkages:     *metaSuffix != "",
-		DocBase:          docURL,
+		EmitStandardLibs:    *doLibNodes,
+		EmitMarkedSource:    *doCodeFacts,
+		EmitLinkages:        *metaSuffix != "",
+		EmitComplexity:      *doComplexity,
+		EmitFileDigests:     *doDigests,
+		EmitImplementations: *doImpls,
+		EmitReturnsError:    *doErrResults,
+		EmitArity:           *doArity,
+		EmitCoverageTargets: *doCoverage,
+		EmitInitOrder:       *doInitOrder,
+		EmitInitFuncValues:  *doInitValues,
+		APIOnly:             *doAPIOnly,
+		SkipGeneratedFiles:  *doSkipGen,
+		EmitTodos:           *doTodos,
+		EmitPromotions:      *doPromotions,
+		EmitMethodSets:      *doMethodSets,
+		EmitErrorMatches:    *doErrMatches,
+		EmitPackageUses:     *doPkgUses,
+		EmitSpreads:         *doSpreads,
+		PlaceholderImports:  *doPlaceholder,
+		EmitKeywordAnchors:  *doKeywords,
+
+		EmitAssertedSatisfactions: *doAsserted,
+		EmitResultAssignments:     *doResults,
+		EmitIndexAccesses:         *doIndexes,
+		EmitRuneOffsets:           *doRunes,
+		EmitMethodInterfaces:      *doMethIfaces,
+		DocBase:                   docURL,
+		DocFormat:                 docFormat,
+		SkipDocNodes:              *doNoDocs,
+		AnchorScheme:              anchors,
 	})
 }
 
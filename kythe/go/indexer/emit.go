@@ -18,15 +18,22 @@ package indexer
 
 import (
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
 	"go/ast"
+	"go/build"
 	"go/token"
 	"go/types"
 	"log"
 	"net/url"
 	"path"
+	"regexp"
+	"sort"
 	"strconv"
 	"strings"
+	"unicode"
+	"unicode/utf8"
 
 	"github.com/golang/protobuf/proto"
 	"golang.org/x/tools/go/types/typeutil"
@@ -54,9 +61,156 @@ type EmitOptions struct {
 	// If true, emit linkages specified by metadata rules.
 	EmitLinkages bool
 
+	// If true, emit a fact on each function recording its cyclomatic
+	// complexity.
+	EmitComplexity bool
+
+	// If true, emit edges from each abstract interface method to the concrete
+	// methods that override it, in addition to the overrides edges in the
+	// other direction.
+	EmitImplementations bool
+
+	// If true, emit an edge from each concrete method to each interface that
+	// its receiver type satisfies and that the method helps to implement.
+	EmitMethodInterfaces bool
+
+	// If true, emit a fact on each file recording the SHA-256 digest of its
+	// text, hex-encoded.
+	EmitFileDigests bool
+
+	// If true, emit a fact on each function whose last result is an error,
+	// recording the type of that result.
+	EmitReturnsError bool
+
+	// If true, emit facts on each function recording the numbers of its
+	// parameters and results.  The receiver of a method is not counted as a
+	// parameter, and a variadic parameter counts as one.
+	EmitArity bool
+
+	// If true, emit a fact on each function and method with a body marking
+	// it as a target for coverage, giving the range of lines from its func
+	// keyword to its closing brace.  Functions in test files and generated
+	// files are skipped.
+	EmitCoverageTargets bool
+
+	// If true, emit ordered edges from the package initializer to each
+	// package-level variable in the order the variables are initialized,
+	// followed by the package's init functions in source order.
+	EmitInitOrder bool
+
+	// If true, blame references to functions and methods used as values
+	// outside of any function, as in "var handler = serve", on the package
+	// initializer, as calls in the same position are.
+	EmitInitFuncValues bool
+
+	// If true, emit only the declarations that make up the API of the
+	// package, skipping the bodies of functions and methods along with the
+	// local declarations and references within them.
+	APIOnly bool
+
+	// If true, do not emit anchors for source files that are marked as
+	// generated code, nor the edges and facts of those anchors, such as the
+	// bindings and references they carry.  The file nodes and their text, and
+	// the nodes declared in such files, are still emitted, so that references
+	// from other files to those declarations resolve.
+	SkipGeneratedFiles bool
+
+	// If true, emit a diagnostic node for each TODO, FIXME, or BUG marker in
+	// a comment, tagged by an anchor spanning the marker and by the nearest
+	// enclosing declaration.
+	EmitTodos bool
+
+	// If true, emit an edge from each struct type to the methods it obtains
+	// from the interfaces embedded in it, directly or through other embedded
+	// fields.
+	EmitPromotions bool
+
+	// If true, emit an edge from each interface type to every method in its
+	// flattened method set, including those it inherits from embedded
+	// interfaces, and from each such method to the interface declaring it.
+	EmitMethodSets bool
+
+	// If true, emit an edge from each function to each imported package it
+	// refers to by name.  References outside any function are attributed to
+	// the package initializer, and references in a function literal to the
+	// literal rather than the function enclosing it.
+	EmitPackageUses bool
+
+	// If true, emit an edge from each call to errors.As to the named type of
+	// error that it matches, as given by the type its target points to.
+	EmitErrorMatches bool
+
+	// If true, emit an edge from each argument spread into a variadic call
+	// ("f(xs...)") to the variadic parameter of the callee.
+	EmitSpreads bool
+
+	// If true, emit an edge from each expression in an explicit return
+	// statement to the named result variable it is assigned to.
+	EmitResultAssignments bool
+
+	// If true, emit an edge from each element access of a map, slice, or
+	// array ("m[k]") to the variable or field indexed, marking whether the
+	// element is written or read.
+	EmitIndexAccesses bool
+
+	// If true, emit facts on each anchor giving its start and end as offsets
+	// in runes rather than bytes, for consumers that count characters.  The
+	// offsets are counted in the text of the source file, after SpanRemap.
+	EmitRuneOffsets bool
+
+	// If true, emit a placeholder package node for each import that cannot be
+	// resolved, so that the import path still refers to a package.  A
+	// diagnostic is emitted for such imports in any case.
+	PlaceholderImports bool
+
+	// If true, emit anchors spanning the func, type, return, and range
+	// keywords, each with a childof edge to the function or type it belongs
+	// to and no other edges.
+	EmitKeywordAnchors bool
+
+	// If true, emit an edge from a type to an interface it satisfies when a
+	// package-level blank variable asserts the satisfaction, as in
+	// "var _ Iface = T{}", in addition to the satisfies edges for all the
+	// interfaces the type is found to satisfy.
+	EmitAssertedSatisfactions bool
+
+	// If set, this function is applied to the offsets of each anchor in the
+	// given file, and the anchor spans the offsets it returns instead.  This
+	// allows anchors in preprocessed sources to be mapped back to the
+	// original text.
+	SpanRemap func(file *spb.VName, start, end int) (int, int)
+
+	// The format of the text of doc nodes.  The default is KytheEscaped.
+	DocFormat DocFormat
+
 	// If set, use this as the base URL for links to godoc.  The import path is
 	// appended to the path of this URL to obtain the target URL to link to.
 	DocBase *url.URL
+
+	// If set, this function is applied to the text of each doc node before it
+	// is formatted according to DocFormat, and its result is used instead.
+	// The target is the node the doc documents.
+	DocNodeTransform func(target *spb.VName, text string) string
+
+	// If true, do not emit doc nodes for documentation comments.  This does
+	// not affect the DocURI facts derived from DocBase.
+	SkipDocNodes bool
+
+	// The scheme by which the vnames of anchors are keyed.  The default is
+	// OffsetAnchors.
+	AnchorScheme AnchorScheme
+
+	// If set, this function is called with the vname and node kind of each
+	// node that is the target of a binding, when its kind fact is emitted.
+	// This allows callers to build their own index of the declarations in a
+	// package as it is emitted.
+	OnNode func(vname *spb.VName, kind string)
+
+	// If set, the facts of each node are gathered and delivered to this
+	// function in a single call per node, once the file that declares them
+	// has been emitted, rather than to the sink one entry at a time.  Edges
+	// are still delivered to the sink.
+	NodeSink NodeSink
 }
 
 // shouldEmit reports whether the indexer should emit a node for the given
@@ -77,6 +231,52 @@ func (e *EmitOptions) docURL(pi *PackageInfo) string {
 	return ""
 }
 
+// docFormat returns the format to use for doc node text.
+func (e *EmitOptions) docFormat() DocFormat {
+	if e == nil {
+		return KytheEscaped
+	}
+	return e.DocFormat
+}
+
+// A DocFormat specifies how the text of a comment is rendered in a doc node.
+// In every format the comment delimiters are removed.
+type DocFormat int
+
+const (
+	// KytheEscaped escapes brackets and backslash characters, per
+	// http://www.kythe.io/docs/schema/#doc.
+	KytheEscaped DocFormat = iota
+
+	// Raw leaves the comment text unchanged.
+	Raw
+
+	// Markdown renders the comment text as Markdown, following the godoc
+	// conventions: indented blocks become code blocks, and all other text
+	// forms paragraphs separated by blank lines.
+	Markdown
+)
+
+// An AnchorScheme specifies how the vname of an anchor is derived from the
+// span of the file it covers.
+type AnchorScheme int
+
+const (
+	// OffsetAnchors keys each anchor by its byte offsets in the file.  Any
+	// edit to a file changes the vnames of all the anchors after it.
+	OffsetAnchors AnchorScheme = iota
+
+	// StableAnchors keys each anchor by a digest of the text it spans, and
+	// the number of earlier occurrences of that text in the file, not
+	// counting those inside longer words; an anchor that is itself inside a
+	// longer word is keyed by its offsets instead.  An edit to a file changes
+	// only the vnames of anchors over text that the edit touches or that
+	// occurs within it, so that re-indexing a changed file does not change
+	// the identities of anchors on unrelated lines.  This costs a search of
+	// the file text for each distinct anchor text.
+	StableAnchors
+)
+
 // An impl records that a type A implements an interface B.
 type impl struct{ A, B types.Object }
 
@@ -84,13 +284,7 @@ type impl struct{ A, B types.Object }
 // sink. In case of errors, processing continues as far as possible before the
 // first error encountered is reported.
 func (pi *PackageInfo) Emit(ctx context.Context, sink Sink, opts *EmitOptions) error {
-	e := &emitter{
-		ctx:  ctx,
-		pi:   pi,
-		sink: sink,
-		opts: opts,
-		impl: make(map[impl]bool),
-	}
+	e := pi.newEmitter(ctx, sink, opts)
 
 	// Emit a node to represent the package as a whole.
 	e.writeFact(pi.VName, facts.NodeKind, nodes.Package)
@@ -98,49 +292,21 @@ func (pi *PackageInfo) Emit(ctx context.Context, sink Sink, opts *EmitOptions) e
 		e.writeFact(pi.VName, facts.DocURI, url)
 	}
 
-	// Emit facts for all the source files claimed by this package.
-	for file, text := range pi.SourceText {
-		vname := pi.FileVName(file)
-		e.writeFact(vname, facts.NodeKind, nodes.File)
-		e.writeFact(vname, facts.Text, text)
-		// All Go source files are encoded as UTF-8, which is the default.
-
-		e.writeEdge(vname, pi.VName, edges.ChildOf)
-	}
-
-	// Traverse the AST of each file in the package for xref entries.
+	// Emit facts and cross-references for all the source files claimed by
+	// this package.
 	for _, file := range pi.Files {
-		e.writeDoc(file.Doc, pi.VName)                        // capture package comments
-		e.writeRef(file.Name, pi.VName, edges.DefinesBinding) // define a binding for the package
-		ast.Walk(newASTVisitor(func(node ast.Node, stack stackFunc) bool {
-			switch n := node.(type) {
-			case *ast.Ident:
-				e.visitIdent(n, stack)
-			case *ast.FuncDecl:
-				e.visitFuncDecl(n, stack)
-			case *ast.FuncLit:
-				e.visitFuncLit(n, stack)
-			case *ast.ValueSpec:
-				e.visitValueSpec(n, stack)
-			case *ast.TypeSpec:
-				e.visitTypeSpec(n, stack)
-			case *ast.ImportSpec:
-				e.visitImportSpec(n, stack)
-			case *ast.AssignStmt:
-				e.visitAssignStmt(n, stack)
-			case *ast.RangeStmt:
-				e.visitRangeStmt(n, stack)
-			case *ast.CompositeLit:
-				e.visitCompositeLit(n, stack)
-			}
-			return true
-		}), file)
+		e.emitFile(file)
 	}
 
 	// Emit edges from each named type to the interface types it satisfies, for
 	// those interface types that are known to this compiltion.
 	e.emitSatisfactions()
 
+	if e.opts != nil && e.opts.EmitInitOrder {
+		e.emitInitOrder()
+	}
+	e.flushNodes()
+
 	// TODO(fromberger): Add diagnostics for type-checker errors.
 	for _, err := range pi.Errors {
 		log.Printf("WARNING: Type resolution error: %v", err)
@@ -148,6 +314,134 @@ func (pi *PackageInfo) Emit(ctx context.Context, sink Sink, opts *EmitOptions) e
 	return e.firstErr
 }
 
+// EmitFile generates Kythe facts and edges for a single source file of pi,
+// and writes them to sink. Type information for the whole package is used to
+// resolve references, so the output is the same as the portion of the output
+// of Emit that belongs to file. Facts and edges that belong to the package as
+// a whole, such as the package node and the satisfaction and override edges
+// among its types, are not generated; use Emit for those.
+func (pi *PackageInfo) EmitFile(ctx context.Context, sink Sink, opts *EmitOptions, file *ast.File) error {
+	if _, ok := pi.SourceText[file]; !ok {
+		return fmt.Errorf("file %q is not a source of package %q",
+			pi.FileSet.Position(file.Pos()).Filename, pi.ImportPath)
+	}
+	e := pi.newEmitter(ctx, sink, opts)
+	e.emitFile(file)
+	e.flushNodes()
+	return e.firstErr
+}
+
+// EmitStream is as Emit, but delivers the entries on a channel rather than to
+// a sink.  Emission runs concurrently, and each entry is delivered only when
+// the consumer is ready to receive it.  The entry channel is closed when
+// emission is complete, after which the error channel delivers the result of
+// Emit.  If ctx ends before all the entries are received, emission stops and
+// the error reports why.  The caller must not otherwise use pi until the
+// result has been delivered.
+func (pi *PackageInfo) EmitStream(ctx context.Context, opts *EmitOptions) (<-chan *spb.Entry, <-chan error) {
+	entries := make(chan *spb.Entry)
+	errc := make(chan error, 1)
+	go func() {
+		defer close(errc)
+		err := pi.Emit(ctx, func(ctx context.Context, entry *spb.Entry) error {
+			select {
+			case entries <- entry:
+				return nil
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}, opts)
+		close(entries)
+		errc <- err
+	}()
+	return entries, errc
+}
+
+// newEmitter returns an emitter that writes the facts and edges for pi to
+// sink.
+func (pi *PackageInfo) newEmitter(ctx context.Context, sink Sink, opts *EmitOptions) *emitter {
+	pi.assignInitSignatures()
+	return &emitter{
+		ctx:     ctx,
+		pi:      pi,
+		sink:    sink,
+		opts:    opts,
+		impl:    make(map[impl]bool),
+		anchors: make(map[vnameKey]bool),
+		pkgUses: make(map[*types.PkgName]importUse),
+	}
+}
+
+// emitFile emits the facts for file and traverses its AST for xref entries.
+func (e *emitter) emitFile(file *ast.File) {
+	vname := e.pi.FileVName(file)
+	fs := []nodeFact{
+		{facts.NodeKind, nodes.File},
+		{facts.Text, e.pi.SourceText[file]},
+	}
+	// All Go source files are encoded as UTF-8, which is the default.
+	if e.opts != nil && e.opts.EmitFileDigests {
+		digest := sha256.Sum256([]byte(e.pi.SourceText[file]))
+		fs = append(fs, nodeFact{factDigest, hex.EncodeToString(digest[:])})
+	}
+	e.writeNode(vname, fs...)
+
+	e.writeEdge(vname, e.pi.VName, edges.ChildOf)
+
+	e.hideAnchors = e.opts != nil && e.opts.SkipGeneratedFiles && isGenerated(file)
+	defer func() { e.hideAnchors = false }()
+
+	e.writeDoc(file.Doc, e.pi.VName)                        // capture package comments
+	e.writeRef(file.Name, e.pi.VName, edges.DefinesBinding) // define a binding for the package
+	ast.Walk(newASTVisitor(func(node ast.Node, stack stackFunc) bool {
+		switch n := node.(type) {
+		case *ast.Ident:
+			e.visitIdent(n, stack)
+		case *ast.FuncDecl:
+			e.visitFuncDecl(n, stack)
+		case *ast.FuncLit:
+			e.visitFuncLit(n, stack)
+		case *ast.ValueSpec:
+			e.visitValueSpec(n, stack)
+		case *ast.TypeSpec:
+			e.visitTypeSpec(n, stack)
+		case *ast.ImportSpec:
+			e.visitImportSpec(n, stack)
+		case *ast.AssignStmt:
+			e.visitAssignStmt(n, stack)
+		case *ast.RangeStmt:
+			e.visitRangeStmt(n, stack)
+		case *ast.ReturnStmt:
+			e.visitReturnStmt(n, stack)
+		case *ast.CompositeLit:
+			e.visitCompositeLit(n, stack)
+		case *ast.IndexExpr:
+			if e.opts != nil && e.opts.EmitIndexAccesses {
+				e.emitIndexAccess(n, stack)
+			}
+		case *ast.BlockStmt:
+			if e.opts != nil && e.opts.APIOnly && isFuncBody(stack) {
+				return false
+			}
+		}
+		if e.opts != nil && e.opts.EmitKeywordAnchors {
+			e.emitKeywordAnchor(node, stack)
+		}
+		return true
+	}), file)
+
+	// Function bodies are skipped in API-only mode, so the uses of imports
+	// within them are not known.
+	if e.opts == nil || !e.opts.APIOnly {
+		e.markImportUses(file)
+	}
+	e.emitLinknames(file)
+	if e.opts != nil && e.opts.EmitTodos && !e.hideAnchors {
+		e.emitTodos(file) // each marker is tagged by an anchor
+	}
+	e.flushNodes()
+}
+
 type emitter struct {
 	ctx      context.Context
 	pi       *PackageInfo
@@ -155,7 +449,24 @@ type emitter struct {
 	opts     *EmitOptions
 	impl     map[impl]bool                        // see checkImplements
 	rmap     map[*ast.File]map[int]metadata.Rules // see applyRules
+	anchors  map[vnameKey]bool                    // see writeAnchor
+	hidden   map[vnameKey]bool                    // anchors not emitted; see writeAnchor
+	runes    map[*ast.File][]runeShift            // see runeOffset
+	occurs   map[*ast.File]map[string][]int       // see stableAnchorVName
+	docLinks map[*ast.CommentGroup]bool           // see emitDocLinks
+	pkgUses  map[*types.PkgName]importUse         // see markImportUses
+	pending  map[vnameKey]int                     // index in nodes; see writeNode
+	nodes    []pendingNode                        // facts not yet delivered to NodeSink
 	firstErr error
+
+	hideAnchors bool // whether anchors in the current file are hidden
+}
+
+// A vnameKey is a comparable copy of the fields of a VName.
+type vnameKey struct{ signature, corpus, root, path, language string }
+
+func keyOf(v *spb.VName) vnameKey {
+	return vnameKey{v.Signature, v.Corpus, v.Root, v.Path, v.Language}
 }
 
 // visitIdent handles referring identifiers. Declaring identifiers are handled
@@ -168,16 +479,135 @@ func (e *emitter) visitIdent(id *ast.Ident, stack stackFunc) {
 	}
 
 	target := e.pi.ObjectVName(obj)
-	e.writeRef(id, target, edges.Ref)
+	ref := e.writeRef(id, target, edges.Ref)
 	if call, ok := isCall(id, obj, stack); ok {
 		callAnchor := e.writeRef(call, target, edges.RefCall)
 
 		// Paint an edge to the function blamed for the call, or if there is
 		// none then to the package initializer.
 		e.writeEdge(callAnchor, e.callContext(stack).vname, edges.ChildOf)
+
+		if e.opts != nil && e.opts.EmitSpreads {
+			e.emitSpread(call, obj)
+		}
+		if e.opts != nil && e.opts.EmitErrorMatches {
+			e.emitErrorMatch(callAnchor, call, obj)
+		}
+	} else if _, ok := obj.(*types.Func); ok && e.opts != nil && e.opts.EmitInitFuncValues {
+		// A function value outside any function is taken by the package
+		// initializer.
+		if fi := e.callContext(stack); fi == e.pi.packageInit {
+			e.writeEdge(ref, fi.vname, edges.ChildOf)
+		}
+	}
+
+	if pkg, ok := obj.(*types.PkgName); ok {
+		e.notePackageUse(pkg, id, stack)
+		if e.opts != nil && e.opts.EmitPackageUses {
+			e.emitPackageUse(e.callContext(stack), pkg.Imported())
+		}
 	}
 }
 
+// An importUse is a set of the ways in which the name of an imported package
+// is used in a file.
+type importUse int
+
+const (
+	valueUse importUse = 1 << iota // qualifies a constant, variable, or function
+	typeUse                        // qualifies a type
+	docUse                         // qualifies a name in a doc link
+)
+
+// notePackageUse records the use of the package name pkg by id, according to
+// what the selector it qualifies denotes.
+func (e *emitter) notePackageUse(pkg *types.PkgName, id *ast.Ident, stack stackFunc) {
+	use := valueUse
+	if sel, ok := stack(1).(*ast.SelectorExpr); ok && sel.X == id {
+		if _, ok := e.pi.Info.Uses[sel.Sel].(*types.TypeName); ok {
+			use = typeUse
+		}
+	}
+	e.pkgUses[pkg] |= use
+}
+
+// markImportUses emits a fact on the anchor of each import of file whose
+// package name is used only to qualify types, or only in doc links, so that
+// such imports are not mistaken for unused ones by consumers that look only
+// for references in code.
+func (e *emitter) markImportUses(file *ast.File) {
+	for _, spec := range file.Imports {
+		pkg := e.importName(spec)
+		if pkg == nil || pkg.Name() == "_" || pkg.Name() == "." {
+			continue // not referred to by name
+		}
+		var mark string
+		switch use := e.pkgUses[pkg]; {
+		case use&valueUse != 0:
+			continue
+		case use&typeUse != 0:
+			mark = importTypeOnly
+		case use&docUse != 0:
+			mark = importDocOnly
+		default:
+			continue
+		}
+		e.writeFact(e.writeSpan(e.pi.Span(spec.Path)), factImportUse, mark)
+	}
+}
+
+// emitPackageUse emits an edge from fn to pkg, unless one has already been
+// emitted.
+func (e *emitter) emitPackageUse(fn *funcInfo, pkg *types.Package) {
+	target := e.pi.PackageVName[pkg]
+	if target == nil || fn.usedPkgs[pkg] {
+		return
+	} else if fn.usedPkgs == nil {
+		fn.usedPkgs = make(map[*types.Package]bool)
+	}
+	fn.usedPkgs[pkg] = true
+	e.writeEdge(fn.vname, target, edgeUsesPackage)
+}
+
+// emitErrorMatch emits an edge from the anchor of call, if it is a call to
+// errors.As, to the named type that its target argument points to, which is
+// the type of error the call matches.  For the usual form
+//
+//   var e *MyError
+//   if errors.As(err, &e) { ... }
+//
+// the edge refers to MyError.  Targets of unnamed types are skipped.
+func (e *emitter) emitErrorMatch(anchor *spb.VName, call *ast.CallExpr, fn types.Object) {
+	if fn.Pkg() == nil || fn.Pkg().Path() != "errors" || fn.Name() != "As" || len(call.Args) != 2 {
+		return
+	}
+	tv, ok := e.pi.Info.Types[call.Args[1]]
+	if !ok {
+		return
+	}
+	ptr, ok := tv.Type.Underlying().(*types.Pointer)
+	if !ok {
+		return // a type error, or a target passed as interface{}
+	}
+	if named, ok := deref(ptr.Elem()).(*types.Named); ok {
+		e.writeEdge(anchor, e.pi.ObjectVName(named.Obj()), edgeMatchesError)
+	}
+}
+
+// emitSpread emits an edge from the final argument of call to the variadic
+// parameter of the callee fn, if that argument is spread ("f(xs...)").
+func (e *emitter) emitSpread(call *ast.CallExpr, fn types.Object) {
+	if !call.Ellipsis.IsValid() || len(call.Args) == 0 {
+		return
+	}
+	sig, ok := fn.Type().(*types.Signature)
+	if !ok || !sig.Variadic() {
+		return // a type error
+	}
+	param := sig.Params().At(sig.Params().Len() - 1)
+	e.writeRef(call.Args[len(call.Args)-1], e.pi.ObjectVName(param), edgeSpreads)
+}
+
 // visitFuncDecl handles function and method declarations and their parameters.
 func (e *emitter) visitFuncDecl(decl *ast.FuncDecl, stack stackFunc) {
 	info := &funcInfo{vname: new(spb.VName)}
@@ -189,16 +619,15 @@ func (e *emitter) visitFuncDecl(decl *ast.FuncDecl, stack stackFunc) {
 		return // a redefinition, for example
 	}
 
-	// Special case: There may be multiple package-level init functions, so
-	// override the normal signature generation to include a discriminator.
-	if decl.Recv == nil && obj.Name() == "init" {
-		e.pi.numInits++
-		e.pi.sigs[obj] = fmt.Sprintf("%s#%d", e.pi.Signature(obj), e.pi.numInits)
-	}
-
 	info.vname = e.mustWriteBinding(decl.Name, nodes.Function, nil)
 	e.writeDef(decl, info.vname)
 	e.writeDoc(decl.Doc, info.vname)
+	e.writeComplexity(info.vname, decl.Body)
+	e.writeReturnsError(info.vname, obj.Type().(*types.Signature))
+	e.writeArity(info.vname, obj.Type().(*types.Signature))
+	if file, ok := stack(1).(*ast.File); ok {
+		e.writeCoverageTarget(file, info.vname, decl)
+	}
 
 	// For concrete methods: Emit the receiver if named, and connect the method
 	// to its declaring type.
@@ -220,6 +649,59 @@ func (e *emitter) visitFuncDecl(decl *ast.FuncDecl, stack stackFunc) {
 	e.emitParameters(decl.Type, sig, info)
 }
 
+// emitKeywordAnchor emits an anchor spanning the keyword that introduces node,
+// if node is a function, a type declaration, a return statement, or a range
+// loop.  The only edge from the anchor is a childof edge to the function or
+// type the keyword belongs to; for a group of type declarations, that is the
+// enclosing function or package.
+func (e *emitter) emitKeywordAnchor(node ast.Node, stack stackFunc) {
+	var (
+		pos    token.Pos
+		kw     string
+		parent *spb.VName
+	)
+	switch n := node.(type) {
+	case *ast.FuncDecl:
+		pos, kw, parent = n.Type.Func, "func", e.pi.function[n].vname
+	case *ast.FuncLit:
+		pos, kw, parent = n.Type.Func, "func", e.pi.function[n].vname
+	case *ast.GenDecl:
+		if n.Tok != token.TYPE {
+			return
+		}
+		pos, kw, parent = n.TokPos, "type", e.nameContext(stack)
+		if spec, ok := n.Specs[0].(*ast.TypeSpec); ok && !n.Lparen.IsValid() {
+			if obj := e.pi.Info.Defs[spec.Name]; obj != nil {
+				parent = e.pi.ObjectVName(obj)
+			}
+		}
+	case *ast.ReturnStmt:
+		pos, kw, parent = n.Return, "return", e.callContext(stack).vname
+	case *ast.RangeStmt:
+		// The position of the range keyword is not recorded, but it is the
+		// last token before the range expression.
+		pos, kw, parent = n.X.Pos(), "range", e.callContext(stack).vname
+	default:
+		return
+	}
+	if !pos.IsValid() || parent == nil || parent.Signature == "" {
+		return // missing position or type error
+	}
+
+	file, _, _ := e.pi.Span(node)
+	start := e.pi.FileSet.Position(pos).Offset
+	if kw == "range" {
+		text := strings.TrimRight(e.pi.SourceText[file][:start], " \t\n")
+		if !strings.HasSuffix(text, kw) {
+			return // e.g., a comment before the range expression
+		}
+		start = len(text) - len(kw)
+	}
+	end := start + len(kw)
+	anchor := e.writeSpan(file, start, end)
+	e.writeEdge(anchor, parent, edges.ChildOf)
+}
+
 // visitFuncLit handles function literals and their parameters.  The signature
 // for a function literal is named relative to the signature of its parent
 // function, or the file scope if the literal is at the top level.
@@ -236,8 +718,11 @@ func (e *emitter) visitFuncLit(flit *ast.FuncLit, stack stackFunc) {
 	e.pi.function[flit] = info
 	e.writeDef(flit, info.vname)
 	e.writeFact(info.vname, facts.NodeKind, nodes.Function)
+	e.writeComplexity(info.vname, flit.Body)
 
 	if sig, ok := e.pi.Info.Types[flit].Type.(*types.Signature); ok {
+		e.writeReturnsError(info.vname, sig)
+		e.writeArity(info.vname, sig)
 		e.emitParameters(flit.Type, sig, info)
 	}
 }
@@ -249,12 +734,18 @@ func (e *emitter) visitValueSpec(spec *ast.ValueSpec, stack stackFunc) {
 		kind = nodes.Constant
 	}
 	doc := specComment(spec, stack)
+	var targets []*spb.VName
 	for _, id := range spec.Names {
 		target := e.writeBinding(id, kind, e.nameContext(stack))
 		if target == nil {
 			continue // type error (reported elsewhere)
 		}
+		e.writeDef(spec, target)
 		e.writeDoc(doc, target)
+		targets = append(targets, target)
+	}
+	if _, ok := stack(2).(*ast.File); ok && kind == nodes.Variable {
+		e.emitEmbeds(spec, doc, targets)
 	}
 
 	// Handle fields of anonymous struct types declared in situ.
@@ -263,6 +754,278 @@ func (e *emitter) visitValueSpec(spec *ast.ValueSpec, stack stackFunc) {
 			e.emitAnonFields(lit.Type)
 		}
 	}
+
+	if _, ok := stack(2).(*ast.File); ok && e.opts != nil && e.opts.EmitAssertedSatisfactions {
+		e.emitAssertedSatisfactions(spec)
+	}
+}
+
+// embedDirective is the prefix of a comment directing the compiler to embed
+// files in the variable that follows it.
+const embedDirective = "//go:embed "
+
+// linknameDirective is the prefix of a comment directing the compiler to link
+// a local declaration to a symbol of another package.
+const linknameDirective = "//go:linkname "
+
+// emitLinknames handles the //go:linkname directives in the comments of file.
+// The local name in each directive gets a reference to the package-level
+// declaration it names.  In the two-argument form,
+//
+//	//go:linkname localname importpath.name
+//
+// the symbol name also gets a reference to the symbol, and an edge from the
+// local declaration to the symbol is emitted.  The symbol is resolved in the
+// package it belongs to if that is a dependency; otherwise its vname is
+// constructed from its import path and name, with the kind of the local
+// declaration.
+func (e *emitter) emitLinknames(file *ast.File) {
+	for _, group := range file.Comments {
+		for _, c := range group.List {
+			if !strings.HasPrefix(c.Text, linknameDirective) {
+				continue
+			}
+			args := strings.Fields(strings.TrimPrefix(c.Text, linknameDirective))
+			if len(args) == 0 || len(args) > 2 {
+				log.Printf("WARNING: Invalid %q directive", c.Text)
+				continue
+			}
+			local := e.pi.Package.Scope().Lookup(args[0])
+			if local == nil {
+				continue // not declared in this package
+			}
+			localName := e.pi.ObjectVName(local)
+			e.writeDirectiveRef(c, args[0], localName, edges.Ref)
+			if len(args) == 1 {
+				continue
+			}
+
+			target := e.linknameTarget(local, args[1])
+			if target == nil {
+				log.Printf("WARNING: Invalid symbol name in %q directive", c.Text)
+				continue
+			}
+			e.writeDirectiveRef(c, args[1], target, edges.Ref)
+			e.writeEdge(localName, target, edgeLinkname)
+		}
+	}
+}
+
+// writeDirectiveRef emits an anchor spanning the argument arg of the
+// directive comment c, with an edge of the given kind to target.
+func (e *emitter) writeDirectiveRef(c *ast.Comment, arg string, target *spb.VName, kind string) {
+	file, start, _ := e.pi.Span(c)
+	i := strings.Index(c.Text[len(linknameDirective):], arg)
+	if file == nil || i < 0 {
+		return
+	}
+	start += len(linknameDirective) + i
+	anchor := e.writeSpan(file, start, start+len(arg))
+	e.writeEdge(anchor, target, kind)
+}
+
+// linknameTarget returns the vname of the symbol named by sym, of the form
+// importpath.name, to which the local declaration is linked, or nil if sym
+// is malformed.
+func (e *emitter) linknameTarget(local types.Object, sym string) *spb.VName {
+	i := strings.LastIndex(sym, "/") + 1
+	j := strings.Index(sym[i:], ".")
+	if j <= 0 || i+j+1 == len(sym) {
+		return nil
+	}
+	ipath, name := sym[:i+j], sym[i+j+1:]
+
+	if ipath == e.pi.ImportPath {
+		if obj := e.pi.Package.Scope().Lookup(name); obj != nil {
+			return e.pi.ObjectVName(obj)
+		}
+	} else if pkg := e.pi.Dependencies[ipath]; pkg != nil {
+		if obj := pkg.Scope().Lookup(name); obj != nil {
+			return e.pi.ObjectVName(obj)
+		}
+	}
+
+	// The symbol is not visible here, so take its kind from the local
+	// declaration: "func localname" becomes "func name".  An import path
+	// whose first element has no dot is taken to be in the standard library.
+	pkg := govname.ForPackage(e.pi.VName.Corpus, &build.Package{
+		ImportPath: ipath,
+		Goroot:     !strings.Contains(strings.SplitN(ipath, "/", 2)[0], "."),
+	})
+	sig := e.pi.Signature(local)
+	if k := strings.Index(sig, " "); k >= 0 {
+		pkg.Signature = sig[:k+1] + name
+	} else {
+		pkg.Signature = name
+	}
+	return pkg
+}
+
+// emitEmbeds emits an edge from each of the targets declared by spec to each
+// file embedded by the //go:embed directives in doc, the comment preceding
+// spec.  A pattern in a directive matches files as described by the embed
+// package: relative to the directory of the source file, and including the
+// files below any directory it matches, except for those whose names begin
+// with "." or "_" unless the pattern has the prefix "all:".
+//
+// Since the files of a directory cannot be listed, a pattern is matched
+// against the inputs of the compilation.  A pattern with no metacharacters is
+// taken to name a file if it matches no inputs.
+func (e *emitter) emitEmbeds(spec *ast.ValueSpec, doc *ast.CommentGroup, targets []*spb.VName) {
+	if doc == nil || len(targets) == 0 {
+		return
+	}
+	var patterns []string
+	for _, c := range doc.List {
+		if strings.HasPrefix(c.Text, embedDirective) {
+			ps, err := embedPatterns(strings.TrimPrefix(c.Text, embedDirective))
+			if err != nil {
+				log.Printf("WARNING: Invalid %q directive: %v", c.Text, err)
+				continue
+			}
+			patterns = append(patterns, ps...)
+		}
+	}
+	if len(patterns) == 0 {
+		return
+	}
+
+	file, _, _ := e.pi.Span(spec)
+	if file == nil {
+		return
+	}
+	src := e.pi.FileVName(file)
+	dir := path.Dir(src.Path)
+	embedded := make(map[vnameKey]*spb.VName)
+	for _, pattern := range patterns {
+		all := strings.HasPrefix(pattern, "all:")
+		glob := path.Join(dir, strings.TrimPrefix(pattern, "all:"))
+		var found bool
+		for _, data := range e.pi.dataFiles {
+			if matchesEmbed(glob, dir, data.Path, all) {
+				embedded[keyOf(data)] = data
+				found = true
+			}
+		}
+		if !found && !strings.ContainsAny(glob, `*?[\`) {
+			vname := proto.Clone(src).(*spb.VName)
+			vname.Path = glob
+			embedded[keyOf(vname)] = vname
+		}
+	}
+
+	var files []*spb.VName
+	for _, vname := range embedded {
+		files = append(files, vname)
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].Path < files[j].Path })
+	for _, target := range targets {
+		for _, vname := range files {
+			e.writeEdge(target, vname, edgeEmbeds)
+		}
+	}
+}
+
+// embedPatterns splits the arguments of a //go:embed directive into patterns,
+// each of which may be quoted as a Go string literal.
+func embedPatterns(args string) ([]string, error) {
+	var patterns []string
+	for args = strings.TrimSpace(args); args != ""; args = strings.TrimSpace(args) {
+		var pattern string
+		switch args[0] {
+		case '"', '`':
+			n := quotedLen(args)
+			if n < 0 {
+				return nil, fmt.Errorf("unterminated string in %q", args)
+			}
+			var err error
+			if pattern, err = strconv.Unquote(args[:n]); err != nil {
+				return nil, fmt.Errorf("invalid string %s: %v", args[:n], err)
+			}
+			args = args[n:]
+		default:
+			n := strings.IndexAny(args, " \t")
+			if n < 0 {
+				n = len(args)
+			}
+			pattern, args = args[:n], args[n:]
+		}
+		patterns = append(patterns, pattern)
+	}
+	return patterns, nil
+}
+
+// quotedLen returns the length of the string literal quoted by the first
+// character of s, or -1 if it is not terminated.
+func quotedLen(s string) int {
+	for i := 1; i < len(s); i++ {
+		if s[i] == '\\' && s[0] == '"' {
+			i++ // skip the escaped character
+		} else if s[i] == s[0] {
+			return i + 1
+		}
+	}
+	return -1
+}
+
+// matchesEmbed reports whether the file with the given name, below the package
+// directory dir, is embedded by glob, either directly or because it is below a
+// directory matched by glob.  Files below a matched directory whose names
+// begin with "." or "_" are excluded unless all is true.
+func matchesEmbed(glob, dir, name string, all bool) bool {
+	if !strings.HasPrefix(name, dir+"/") {
+		return false
+	}
+	for p := name; p != dir; p = path.Dir(p) {
+		if ok, _ := path.Match(glob, p); ok {
+			return true
+		} else if base := path.Base(p); !all && (base[0] == '.' || base[0] == '_') {
+			return false // hidden below whatever directory may match
+		}
+	}
+	return false
+}
+
+// emitAssertedSatisfactions checks whether spec declares blank variables of a
+// named interface type, as in
+//
+//	var _ Iface = T{}
+//	var _ Iface = (*T)(nil)
+//
+// and if so emits an edge from the named type of each value to the interface,
+// recording that the programmer asserted the satisfaction.
+func (e *emitter) emitAssertedSatisfactions(spec *ast.ValueSpec) {
+	if spec.Type == nil {
+		return
+	}
+	iface, ok := e.pi.Info.Types[spec.Type].Type.(*types.Named)
+	if !ok || !isInterface(iface) {
+		return
+	}
+	for i, id := range spec.Names {
+		if id.Name != "_" || i >= len(spec.Values) {
+			continue
+		}
+		if named, ok := deref(e.pi.Info.Types[spec.Values[i]].Type).(*types.Named); ok && !isInterface(named) {
+			e.writeEdge(e.pi.ObjectVName(named.Obj()), e.pi.ObjectVName(iface.Obj()), edgeAssertedSatisfies)
+		}
+	}
+}
+
+// typeName returns the type name denoted by expr if it is a possibly-qualified
+// identifier, or nil.
+func (e *emitter) typeName(expr ast.Expr) *types.TypeName {
+	switch t := expr.(type) {
+	case *ast.Ident:
+		obj, _ := e.pi.Info.Uses[t].(*types.TypeName)
+		return obj
+	case *ast.SelectorExpr:
+		obj, _ := e.pi.Info.Uses[t.Sel].(*types.TypeName)
+		return obj
+	case *ast.ParenExpr:
+		return e.typeName(t.X)
+	}
+	return nil
 }
 
 // visitTypeSpec handles type declarations, including the bindings for fields
@@ -276,10 +1039,16 @@ func (e *emitter) visitTypeSpec(spec *ast.TypeSpec, stack stackFunc) {
 	e.writeDef(spec, target)
 	e.writeDoc(specComment(spec, stack), target)
 
+	// If the type is defined in terms of another named type, either builtin
+	// or declared, link them so the definition can be followed.
+	if tobj := e.typeName(spec.Type); tobj != nil {
+		e.writeEdge(target, e.pi.ObjectVName(tobj), edgeDefinedFrom)
+	}
+
 	// Emit type-specific structure.
 	switch t := obj.Type().Underlying().(type) {
 	case *types.Struct:
-		e.writeFact(target, facts.NodeKind, nodes.Record)
+		e.writeBindingKind(target, nodes.Record)
 		e.writeFact(target, facts.Subkind, nodes.Struct)
 		// Add parent edges for all fields, including promoted ones.
 		for i, n := 0, t.NumFields(); i < n; i++ {
@@ -291,9 +1060,16 @@ func (e *emitter) visitTypeSpec(spec *ast.TypeSpec, stack stackFunc) {
 		if st, ok := spec.Type.(*ast.StructType); ok {
 			mapFields(st.Fields, func(i int, id *ast.Ident) {
 				target := e.writeVarBinding(id, nodes.Field, nil)
-				e.writeDoc(st.Fields.List[i].Doc, target)
+				e.writeFieldDef(st.Fields.List[i], target)
 			})
 
+			// Add bindings for the parameters of function-typed fields.
+			for _, field := range st.Fields.List {
+				if _, ok := field.Type.(*ast.FuncType); ok {
+					e.emitAnonFields(field.Type)
+				}
+			}
+
 			// Handle anonymous fields. Such fields behave as if they were
 			// named by the base identifier of their type.
 			for _, field := range st.Fields.List {
@@ -306,18 +1082,21 @@ func (e *emitter) visitTypeSpec(spec *ast.TypeSpec, stack stackFunc) {
 					// Don't write a fresh anchor here; we already wrote one as
 					// part of the ref to the type, and we don't want duplicate
 					// outputs.
-					anchor := e.pi.AnchorVName(e.pi.Span(id))
+					anchor, _, _ := e.anchorSpan(e.pi.Span(id))
 					target := e.pi.ObjectVName(obj)
 					e.writeEdge(anchor, target, edges.DefinesBinding)
-					e.writeFact(target, facts.NodeKind, nodes.Variable)
+					e.writeBindingKind(target, nodes.Variable)
 					e.writeFact(target, facts.Subkind, nodes.Field)
-					e.writeDoc(field.Doc, target)
+					e.writeFieldDef(field, target)
 				}
 			}
 		}
+		if e.opts != nil && e.opts.EmitPromotions {
+			e.emitPromotions(obj.Type(), target)
+		}
 
 	case *types.Interface:
-		e.writeFact(target, facts.NodeKind, nodes.Interface)
+		e.writeBindingKind(target, nodes.Interface)
 		// Add parent edges for all methods, including inherited ones.
 		for i, n := 0, t.NumMethods(); i < n; i++ {
 			e.writeEdge(e.pi.ObjectVName(t.Method(i)), target, edges.ChildOf)
@@ -328,6 +1107,9 @@ func (e *emitter) visitTypeSpec(spec *ast.TypeSpec, stack stackFunc) {
 				e.writeEdge(target, e.pi.ObjectVName(eobj), edges.Extends)
 			}
 		}
+		if e.opts != nil && e.opts.EmitMethodSets {
+			e.emitMethodSet(obj.Type(), target)
+		}
 
 		// Add bindings for the explicitly-named methods in this declaration.
 		// Parent edges were already added, so skip them here.
@@ -343,7 +1125,7 @@ func (e *emitter) visitTypeSpec(spec *ast.TypeSpec, stack stackFunc) {
 		// unexported field of the underlying type. That is not really what Go
 		// does, but it is close enough for the graph model to work. Since
 		// there is no actual field declaration, however, we don't emit that.
-		e.writeFact(target, facts.NodeKind, nodes.Record)
+		e.writeBindingKind(target, nodes.Record)
 		e.writeFact(target, facts.Subkind, nodes.Type)
 	}
 }
@@ -357,6 +1139,15 @@ func (e *emitter) visitImportSpec(spec *ast.ImportSpec, stack stackFunc) {
 	)
 	if target == nil {
 		log.Printf("Unable to resolve import path %q", ipath)
+		file, start, end := e.pi.Span(spec.Path)
+		anchor := e.writeSpan(file, start, end)
+		e.writeDiagnostic(anchor, "import", fmt.Sprintf("unable to resolve import path %q", ipath))
+
+		if e.opts != nil && e.opts.PlaceholderImports {
+			target = govname.ForPackage(e.pi.VName.Corpus, &build.Package{ImportPath: ipath})
+			e.writeFact(target, facts.NodeKind, nodes.Package)
+			e.writeEdge(anchor, target, edges.RefImports)
+		}
 		return
 	}
 
@@ -406,9 +1197,117 @@ func (e *emitter) visitRangeStmt(stmt *ast.RangeStmt, stack stackFunc) {
 	}
 }
 
-// visitCompositeLit handles references introduced by positional initializers
-// in composite literals that construct (pointer to) struct values. Named
-// initializers are handled separately.
+// visitReturnStmt handles the implicit references to named result variables
+// made by a naked return statement.
+func (e *emitter) visitReturnStmt(stmt *ast.ReturnStmt, stack stackFunc) {
+	ftype := enclosingFuncType(stack)
+	if ftype == nil {
+		return // malformed code; a return outside any function
+	}
+	if len(stmt.Results) != 0 {
+		// Results are explicit; they are handled as expressions.
+		if e.opts != nil && e.opts.EmitResultAssignments {
+			e.emitResultAssignments(stmt, ftype)
+		}
+		return
+	}
+	mapFields(ftype.Results, func(_ int, id *ast.Ident) {
+		if obj := e.pi.Info.Defs[id]; obj != nil && id.Name != "_" {
+			e.writeRef(stmt, e.pi.ObjectVName(obj), edges.Ref)
+		}
+	})
+}
+
+// emitResultAssignments emits an edge from each expression returned by stmt to
+// the corresponding named result of ftype, e.g., from "count" to "n" in
+//
+//	func f() (n int) { return count }
+//
+// Unnamed and blank results get no edge, nor do the results of a return
+// statement that forwards a multiple-valued call.
+func (e *emitter) emitResultAssignments(stmt *ast.ReturnStmt, ftype *ast.FuncType) {
+	var results []*ast.Ident // by position; nil for unnamed results
+	if ftype.Results != nil {
+		for _, field := range ftype.Results.List {
+			if len(field.Names) == 0 {
+				results = append(results, nil)
+			}
+			results = append(results, field.Names...)
+		}
+	}
+	if len(results) != len(stmt.Results) {
+		return // a forwarded call, or malformed code
+	}
+	for i, expr := range stmt.Results {
+		id := results[i]
+		if id == nil || id.Name == "_" {
+			continue
+		}
+		if obj := e.pi.Info.Defs[id]; obj != nil {
+			e.writeRef(expr, e.pi.ObjectVName(obj), edgeAssignsResult)
+		}
+	}
+}
+
+// emitIndexAccess emits an anchor spanning the element access expr, with an
+// edge to the variable or field it indexes: edgeWrites if the element is
+// assigned to, and edgeReads otherwise.  Accesses to the elements of strings,
+// which cannot be written, and to values that are not named by an identifier
+// or selector, such as the results of calls, get no anchor.
+func (e *emitter) emitIndexAccess(expr *ast.IndexExpr, stack stackFunc) {
+	if tv, ok := e.pi.Info.Types[expr.X]; !ok || isString(tv.Type) {
+		return
+	}
+	var id *ast.Ident
+	switch x := expr.X.(type) {
+	case *ast.Ident:
+		id = x
+	case *ast.SelectorExpr:
+		id = x.Sel
+	default:
+		return
+	}
+	obj, ok := e.pi.Info.Uses[id].(*types.Var)
+	if !ok {
+		return
+	}
+	kind := edgeReads
+	if isWritten(expr, stack) {
+		kind = edgeWrites
+	}
+	e.writeRef(expr, e.pi.ObjectVName(obj), kind)
+}
+
+// isString reports whether the underlying type of typ is a string type.
+func isString(typ types.Type) bool {
+	b, ok := typ.Underlying().(*types.Basic)
+	return ok && b.Info()&types.IsString != 0
+}
+
+// isWritten reports whether expr, whose ancestors are given by stack, is the
+// target of an assignment, an increment or decrement, or the key or value
+// assignment of a range loop.
+func isWritten(expr ast.Expr, stack stackFunc) bool {
+	switch p := stack(1).(type) {
+	case *ast.AssignStmt:
+		for _, lhs := range p.Lhs {
+			if lhs == expr {
+				return true
+			}
+		}
+	case *ast.IncDecStmt:
+		return p.X == expr
+	case *ast.RangeStmt:
+		return p.Tok == token.ASSIGN && (p.Key == expr || p.Value == expr)
+	}
+	return false
+}
+
+// visitCompositeLit handles references introduced by initializers in composite
+// literals that construct (pointer to) struct values. The field names of named
+// initializers are handled separately. Struct literals nested inside slice,
+// array, and map literals, whose types may be elided, are visited in turn by
+// the walk.
 func (e *emitter) visitCompositeLit(expr *ast.CompositeLit, stack stackFunc) {
 	if len(expr.Elts) == 0 {
 		return // no fields to initialize
@@ -419,9 +1318,9 @@ func (e *emitter) visitCompositeLit(expr *ast.CompositeLit, stack stackFunc) {
 		log.Printf("WARNING: Unable to determine composite literal type (%s)", e.pi.FileSet.Position(expr.Pos()))
 		return
 	}
-	sv, ok := deref(tv.Type.Underlying()).(*types.Struct)
+	sv, ok := deref(tv.Type).Underlying().(*types.Struct)
 	if !ok {
-		return // non-struct type, e.g. a slice; nothing to do here
+		return // non-struct type, e.g. a slice; its elements are visited separately
 	}
 
 	if n := sv.NumFields(); n < len(expr.Elts) {
@@ -435,10 +1334,15 @@ func (e *emitter) visitCompositeLit(expr *ast.CompositeLit, stack stackFunc) {
 	}
 	for i, elt := range expr.Elts {
 		// The keys for key-value initializers are handled upstream of us, so
-		// we need only handle the values.
+		// we need only handle the values. Keyed elements may appear in any
+		// order, so resolve the field from the key rather than the position.
 		switch t := elt.(type) {
 		case *ast.KeyValueExpr:
-			e.emitPosRef(t.Value, sv.Field(i), edges.RefInit)
+			if id, ok := t.Key.(*ast.Ident); ok {
+				if fld, ok := e.pi.Info.Uses[id].(*types.Var); ok && fld.IsField() {
+					e.emitPosRef(t.Value, fld, edges.RefInit)
+				}
+			}
 		default:
 			e.emitPosRef(t, sv.Field(i), edges.RefInit)
 		}
@@ -449,8 +1353,7 @@ func (e *emitter) visitCompositeLit(expr *ast.CompositeLit, stack stackFunc) {
 func (e *emitter) emitPosRef(loc ast.Node, obj types.Object, kind string) {
 	target := e.pi.ObjectVName(obj)
 	file, start, end := e.pi.Span(loc)
-	anchor := e.pi.AnchorVName(file, start, end)
-	e.writeAnchor(anchor, start, end)
+	anchor := e.writeSpan(file, start, end)
 	e.writeEdge(anchor, target, kind)
 }
 
@@ -465,16 +1368,35 @@ func (e *emitter) emitParameters(ftype *ast.FuncType, sig *types.Signature, info
 		paramIndex++
 	}
 
-	// Emit bindings and parameter edges for the parameters.
-	mapFields(ftype.Params, func(i int, id *ast.Ident) {
-		if sig.Params().At(i) != nil {
-			if param := e.writeBinding(id, nodes.Variable, info.vname); param != nil {
+	// Emit bindings and parameter edges for the parameters.  Unnamed
+	// parameters have no bindings, but still get nodes and parameter edges so
+	// that the positions of the rest are preserved.
+	var i int // index in sig.Params()
+	for _, field := range ftype.Params.List {
+		ids := field.Names
+		if len(ids) == 0 {
+			ids = []*ast.Ident{nil} // unnamed
+		}
+		for _, id := range ids {
+			if i >= sig.Params().Len() {
+				break
+			}
+			var param *spb.VName
+			if id != nil {
+				param = e.writeBinding(id, nodes.Variable, info.vname)
+			} else {
+				param = e.pi.ObjectVName(sig.Params().At(i))
+				e.writeFact(param, facts.NodeKind, nodes.Variable)
+				e.writeEdge(param, info.vname, edges.ChildOf)
+			}
+			if param != nil {
 				e.writeEdge(info.vname, param, edges.ParamIndex(paramIndex))
-				e.emitAnonFields(ftype.Params.List[i].Type)
+				e.emitAnonFields(field.Type)
 			}
+			paramIndex++
+			i++
 		}
-		paramIndex++
-	})
+	}
 	// Emit bindings for any named result variables.
 	// Results are not considered parameters.
 	mapFields(ftype.Results, func(i int, id *ast.Ident) {
@@ -486,11 +1408,32 @@ func (e *emitter) emitParameters(ftype *ast.FuncType, sig *types.Signature, info
 // so emits bindings for the fields of that struct. The resulting fields do not
 // parent to the struct, since it has no referential identity; but we do
 // capture documentation in the unlikely event someone wrote any.
+//
+// Likewise, if expr denotes a function type, emits bindings for its named
+// parameters and results, which have no parent function; and if expr denotes
+// an anonymous interface type, emits bindings for its methods, which have no
+// parent interface.
 func (e *emitter) emitAnonFields(expr ast.Expr) {
-	if st, ok := expr.(*ast.StructType); ok {
-		mapFields(st.Fields, func(i int, id *ast.Ident) {
+	switch t := expr.(type) {
+	case *ast.StructType:
+		mapFields(t.Fields, func(i int, id *ast.Ident) {
 			target := e.writeVarBinding(id, nodes.Field, nil) // no parent
-			e.writeDoc(st.Fields.List[i].Doc, target)
+			e.writeFieldDef(t.Fields.List[i], target)
+		})
+		for _, field := range t.Fields.List {
+			if _, ok := field.Type.(*ast.FuncType); ok {
+				e.emitAnonFields(field.Type)
+			}
+		}
+
+	case *ast.FuncType:
+		bind := func(_ int, id *ast.Ident) { e.writeBinding(id, nodes.Variable, nil) }
+		mapFields(t.Params, bind)
+		mapFields(t.Results, bind)
+
+	case *ast.InterfaceType:
+		mapFields(t.Methods, func(_ int, id *ast.Ident) {
+			e.writeBinding(id, nodes.Function, nil) // no parent
 		})
 	}
 }
@@ -521,7 +1464,8 @@ func (e *emitter) emitSatisfactions() {
 	// Find the names of all defined types mentioned in this compilation.
 	var allNames []*types.TypeName
 
-	// For the current source package, use all names, even local ones.
+	// For the current source package, use all names, even local ones.  These
+	// come from a map, so put them in source order to keep the output stable.
 	for _, obj := range e.pi.Info.Defs {
 		if obj, ok := obj.(*types.TypeName); ok {
 			if _, ok := obj.Type().(*types.Named); ok {
@@ -529,11 +1473,17 @@ func (e *emitter) emitSatisfactions() {
 			}
 		}
 	}
+	sort.Slice(allNames, func(i, j int) bool { return allNames[i].Pos() < allNames[j].Pos() })
 
 	// For dependencies, we only have access to package-level types, not those
-	// defined by inner scopes.
-	for _, pkg := range e.pi.Dependencies {
-		scope := pkg.Scope()
+	// defined by inner scopes.  Visit them in order of import path.
+	var deps []string
+	for ipath := range e.pi.Dependencies {
+		deps = append(deps, ipath)
+	}
+	sort.Strings(deps)
+	for _, ipath := range deps {
+		scope := e.pi.Dependencies[ipath].Scope()
 		for _, name := range scope.Names() {
 			if obj, ok := scope.Lookup(name).(*types.TypeName); ok {
 				if _, ok := obj.Type().(*types.Named); ok {
@@ -547,6 +1497,7 @@ func (e *emitter) emitSatisfactions() {
 	var msets typeutil.MethodSetCache
 	// Cache the overrides we've noticed to avoid duplicate entries.
 	cache := make(overrides)
+	ifaces := make(overrides) // :: method → interface, for emitMethodInterfaces
 	for _, xobj := range allNames {
 		if xobj.Pkg() != e.pi.Package {
 			continue // not from this package
@@ -593,13 +1544,19 @@ func (e *emitter) emitSatisfactions() {
 
 			case ify && ymset.Len() > 0:
 				// x is a concrete type
+				var smset *types.MethodSet // the method set that satisfies y
 				if types.AssignableTo(x, y) {
 					e.writeSatisfies(xobj, yobj)
+					smset = xmset
 				} else if px := types.NewPointer(x); types.AssignableTo(px, y) {
 					e.writeSatisfies(xobj, yobj)
+					smset = msets.MethodSet(px)
 					// TODO(fromberger): Do we want this case?
 				}
 				e.emitOverrides(xmset, ymset, cache)
+				if smset != nil && e.opts != nil && e.opts.EmitMethodInterfaces {
+					e.emitMethodInterfaces(smset, ymset, yobj, ifaces)
+				}
 
 			default:
 				// Both x and y are concrete.
@@ -620,13 +1577,107 @@ func (e *emitter) emitOverrides(xmset, ymset *types.MethodSet, cache overrides)
 		}
 
 		xobj := xm.Obj()
-		if cache.seen(xobj, yobj) {
+		if xobj == yobj {
+			continue // promoted from an embedded interface
+		} else if cache.seen(xobj, yobj) {
 			continue
 		}
 
 		xvname := e.pi.ObjectVName(xobj)
 		yvname := e.pi.ObjectVName(yobj)
 		e.writeEdge(xvname, yvname, edges.Overrides)
+		if e.opts != nil && e.opts.EmitImplementations {
+			e.writeEdge(yvname, xvname, edgeImplementedBy)
+		}
+	}
+}
+
+// emitMethodInterfaces emits an edge from each concrete method in xmset that
+// implements a method of the interface type yobj, whose method set is ymset,
+// to yobj.  The method set xmset must satisfy the interface.
+func (e *emitter) emitMethodInterfaces(xmset, ymset *types.MethodSet, yobj types.Object, cache overrides) {
+	for i, n := 0, ymset.Len(); i < n; i++ {
+		ym := ymset.At(i).Obj()
+		xm := xmset.Lookup(ym.Pkg(), ym.Name())
+		if xm == nil {
+			continue // not reached if xmset satisfies the interface
+		} else if xm.Obj() == ym {
+			continue // promoted from an embedded interface
+		} else if cache.seen(xm.Obj(), yobj) {
+			continue
+		}
+		e.writeEdge(e.pi.ObjectVName(xm.Obj()), e.pi.ObjectVName(yobj), edgeSatisfiesIn)
+	}
+}
+
+// emitPromotions emits edges from the struct type denoted by target to each
+// method in the method set of typ (or of a pointer to typ) that is promoted
+// from an embedded interface.  Calls to such methods dispatch dynamically to
+// the value stored in the embedded field.
+func (e *emitter) emitPromotions(typ types.Type, target *spb.VName) {
+	for _, sel := range typeutil.IntuitiveMethodSet(typ, nil) {
+		if len(sel.Index()) < 2 {
+			continue // declared directly on typ
+		}
+		fn, ok := sel.Obj().(*types.Func)
+		if !ok {
+			continue
+		}
+		if recv := fn.Type().(*types.Signature).Recv(); recv != nil && isInterface(recv.Type()) {
+			e.writeEdge(target, e.pi.ObjectVName(fn), edgePromotes)
+		}
+	}
+}
+
+// emitMethodSet emits an edge from the interface type denoted by target to
+// each method in its flattened method set, and from each method declared
+// directly in the interface back to it. Inherited methods get their origin
+// edges from the interface that declares them, so each method has just one.
+func (e *emitter) emitMethodSet(typ types.Type, target *spb.VName) {
+	for _, sel := range typeutil.IntuitiveMethodSet(typ, nil) {
+		fn, ok := sel.Obj().(*types.Func)
+		if !ok {
+			continue
+		}
+		method := e.pi.ObjectVName(fn)
+		e.writeEdge(target, method, edgeMethodSet)
+		if recv := fn.Type().(*types.Signature).Recv(); recv != nil && recv.Type() == typ {
+			e.writeEdge(method, target, edgeMethodOrigin)
+		}
+	}
+}
+
+// emitInitOrder emits edges from the package initializer to each package-level
+// variable, numbered in the order that the type checker determined the
+// variables will be initialized at runtime, followed by the package-level init
+// functions in source order, which run after all the variables have been
+// initialized.
+func (e *emitter) emitInitOrder() {
+	var targets []*spb.VName
+	for _, initializer := range e.pi.Info.InitOrder {
+		for _, v := range initializer.Lhs {
+			if v.Name() != "_" {
+				targets = append(targets, e.pi.ObjectVName(v))
+			}
+		}
+	}
+	for _, file := range e.pi.Files {
+		for _, decl := range file.Decls {
+			fd, ok := decl.(*ast.FuncDecl)
+			if !ok || fd.Recv != nil || fd.Name.Name != "init" {
+				continue
+			}
+			if obj := e.pi.Info.Defs[fd.Name]; obj != nil {
+				targets = append(targets, e.pi.ObjectVName(obj))
+			}
+		}
+	}
+	if len(targets) == 0 {
+		return
+	}
+	src := e.packageInit().vname
+	for i, target := range targets {
+		e.writeEdge(src, target, edgeInitOrder+"."+strconv.Itoa(i))
 	}
 }
 
@@ -655,23 +1706,226 @@ func (e *emitter) writeSatisfies(src, tgt types.Object) {
 }
 
 func (e *emitter) writeFact(src *spb.VName, name, value string) {
+	if e.isHidden(src) {
+		return
+	} else if e.opts != nil && e.opts.NodeSink != nil {
+		e.addFacts(src, nodeFact{name, value})
+		return
+	}
 	e.check(e.sink.writeFact(e.ctx, src, name, value))
 }
 
 func (e *emitter) writeEdge(src, tgt *spb.VName, kind string) {
-	e.check(e.sink.writeEdge(e.ctx, src, tgt, kind))
+	if !e.isHidden(src) && !e.isHidden(tgt) {
+		e.check(e.sink.writeEdge(e.ctx, src, tgt, kind))
+	}
+}
+
+// isHidden reports whether v is an anchor that is not emitted, in which case
+// neither are its facts or the edges to and from it.
+func (e *emitter) isHidden(v *spb.VName) bool {
+	return len(e.hidden) > 0 && e.hidden[keyOf(v)]
+}
+
+// writeNode emits the facts fs of the node src.  If a NodeSink is set, they
+// are gathered with any other facts of src until flushNodes delivers them in
+// a single call; otherwise they are written as separate entries to the sink.
+func (e *emitter) writeNode(src *spb.VName, fs ...nodeFact) {
+	if e.isHidden(src) {
+		return
+	} else if e.opts == nil || e.opts.NodeSink == nil {
+		e.check(e.sink.writeNode(e.ctx, src, fs))
+		return
+	}
+	e.addFacts(src, fs...)
+}
+
+// A pendingNode holds the facts of a node not yet delivered to the NodeSink.
+type pendingNode struct {
+	vname  *spb.VName
+	values map[string]string
+}
+
+// addFacts records the facts fs of src for delivery by flushNodes.
+func (e *emitter) addFacts(src *spb.VName, fs ...nodeFact) {
+	key := keyOf(src)
+	i, ok := e.pending[key]
+	if !ok {
+		if e.pending == nil {
+			e.pending = make(map[vnameKey]int)
+		}
+		i = len(e.nodes)
+		e.pending[key] = i
+		e.nodes = append(e.nodes, pendingNode{src, make(map[string]string, len(fs))})
+	}
+	for _, f := range fs {
+		e.nodes[i].values[f.name] = f.value
+	}
+}
+
+// flushNodes delivers the facts recorded by addFacts to the NodeSink, one
+// call per node in the order the nodes were first written.  It is called
+// after each file, by which point the facts of the nodes the file declares,
+// including the import uses of its anchors, are complete.
+func (e *emitter) flushNodes() {
+	for _, n := range e.nodes {
+		e.check(e.opts.NodeSink(e.ctx, n.vname, n.values))
+	}
+	e.pending, e.nodes = nil, nil
+}
+
+// writeAnchor emits the facts for the anchor src, unless they have already
+// been emitted for an earlier edge from the same span.  In a generated file
+// skipped by SkipGeneratedFiles, the anchor is instead recorded as hidden.
+func (e *emitter) writeAnchor(file *ast.File, src *spb.VName, start, end int) {
+	if key := keyOf(src); !e.anchors[key] {
+		e.anchors[key] = true
+		if e.hideAnchors {
+			if e.hidden == nil {
+				e.hidden = make(map[vnameKey]bool)
+			}
+			e.hidden[key] = true
+			return
+		}
+		fs := []nodeFact{
+			{facts.NodeKind, nodes.Anchor},
+			{facts.AnchorStart, strconv.Itoa(start)},
+			{facts.AnchorEnd, strconv.Itoa(end)},
+		}
+		if e.opts != nil && e.opts.EmitRuneOffsets {
+			fs = append(fs,
+				nodeFact{factRuneStart, strconv.Itoa(e.runeOffset(file, start))},
+				nodeFact{factRuneEnd, strconv.Itoa(e.runeOffset(file, end))})
+		}
+		e.writeNode(src, fs...)
+	}
+}
+
+// A runeShift records that the bytes of a file up to offset end hold shift
+// more bytes than runes.
+type runeShift struct{ end, shift int }
+
+// runeOffset converts the byte offset off in the text of file to an offset in
+// runes.  The multi-byte runes of each file are recorded the first time it is
+// needed, so that each conversion is a binary search among them.
+func (e *emitter) runeOffset(file *ast.File, off int) int {
+	shifts, ok := e.runes[file]
+	if !ok {
+		text := e.pi.SourceText[file]
+		var shift int
+		for i := 0; i < len(text); {
+			_, n := utf8.DecodeRuneInString(text[i:]) // an invalid byte is one rune
+			i += n
+			if n > 1 {
+				shift += n - 1
+				shifts = append(shifts, runeShift{end: i, shift: shift})
+			}
+		}
+		if e.runes == nil {
+			e.runes = make(map[*ast.File][]runeShift)
+		}
+		e.runes[file] = shifts
+	}
+
+	// Find the last multi-byte rune ending at or before off.
+	i := sort.Search(len(shifts), func(i int) bool { return shifts[i].end > off })
+	if i == 0 {
+		return off
+	}
+	return off - shifts[i-1].shift
+}
+
+// anchorSpan returns the vname of the anchor spanning the given offsets of
+// file, along with the offsets of the anchor, which are remapped according to
+// the options.
+func (e *emitter) anchorSpan(file *ast.File, start, end int) (*spb.VName, int, int) {
+	if e.opts != nil && e.opts.SpanRemap != nil {
+		start, end = e.opts.SpanRemap(e.pi.FileVName(file), start, end)
+	}
+	if e.opts != nil && e.opts.AnchorScheme == StableAnchors {
+		return e.stableAnchorVName(file, start, end), start, end
+	}
+	return e.pi.AnchorVName(file, start, end), start, end
+}
+
+// stableAnchorVName returns a vname for the anchor spanning the given offsets
+// of file, per the StableAnchors scheme.  The offsets of the occurrences of
+// each distinct anchor text are recorded the first time it is needed, so that
+// the ordinal of each occurrence is a binary search among them.
+func (e *emitter) stableAnchorVName(file *ast.File, start, end int) *spb.VName {
+	text := e.pi.SourceText[file]
+	if start < 0 || start > end || end > len(text) {
+		return e.pi.AnchorVName(file, start, end) // no text to key on
+	}
+	span := text[start:end]
+	n := start // every offset is an occurrence of the empty string
+	if span != "" {
+		occurs := e.occurs[file]
+		if occurs == nil {
+			occurs = make(map[string][]int)
+			if e.occurs == nil {
+				e.occurs = make(map[*ast.File]map[string][]int)
+			}
+			e.occurs[file] = occurs
+		}
+		offs, ok := occurs[span]
+		if !ok {
+			for i := strings.Index(text, span); i >= 0; {
+				if !splitsWord(text, span, i) {
+					offs = append(offs, i)
+				}
+				j := strings.Index(text[i+1:], span)
+				if j < 0 {
+					break
+				}
+				i += j + 1
+			}
+			occurs[span] = offs
+		}
+		n = sort.SearchInts(offs, start)
+		if n == len(offs) || offs[n] != start {
+			// The span is within a longer word, so it is not counted among
+			// the occurrences, and sharing the ordinal of the next one would
+			// give two anchors the same vname.
+			return e.pi.AnchorVName(file, start, end)
+		}
+	}
+	digest := sha256.Sum256([]byte(span))
+	vname := proto.Clone(e.pi.FileVName(file)).(*spb.VName)
+	vname.Signature = "@" + hex.EncodeToString(digest[:8]) + ":" + strconv.Itoa(n)
+	vname.Language = govname.Language
+	return vname
+}
+
+// splitsWord reports whether the occurrence of span at offset i of text is
+// part of a longer word, that is, whether span begins or ends with a letter or
+// digit that continues a word in the adjacent text.  Such occurrences are not
+// counted by stableAnchorVName, so that the ordinals of identifiers do not
+// depend on other words that contain them.
+func splitsWord(text, span string, i int) bool {
+	first, _ := utf8.DecodeRuneInString(span)
+	last, _ := utf8.DecodeLastRuneInString(span)
+	before, _ := utf8.DecodeLastRuneInString(text[:i])
+	after, _ := utf8.DecodeRuneInString(text[i+len(span):])
+	return (isWordRune(first) && i > 0 && isWordRune(before)) ||
+		(isWordRune(last) && i+len(span) < len(text) && isWordRune(after))
 }
 
-func (e *emitter) writeAnchor(src *spb.VName, start, end int) {
-	e.check(e.sink.writeAnchor(e.ctx, src, start, end))
+func isWordRune(r rune) bool { return r == '_' || unicode.IsLetter(r) || unicode.IsDigit(r) }
+
+// writeSpan emits an anchor spanning the given offsets of file, and returns
+// its vname.
+func (e *emitter) writeSpan(file *ast.File, start, end int) *spb.VName {
+	anchor, start, end := e.anchorSpan(file, start, end)
+	e.writeAnchor(file, anchor, start, end)
+	return anchor
 }
 
 // writeRef emits an anchor spanning origin and referring to target with an
 // edge of the given kind. The vname of the anchor is returned.
 func (e *emitter) writeRef(origin ast.Node, target *spb.VName, kind string) *spb.VName {
 	file, start, end := e.pi.Span(origin)
-	anchor := e.pi.AnchorVName(file, start, end)
-	e.writeAnchor(anchor, start, end)
+	anchor := e.writeSpan(file, start, end)
 	e.writeEdge(anchor, target, kind)
 
 	// Check whether we are intended to emit metadata linkage edges, and if so,
@@ -719,7 +1973,7 @@ func (e *emitter) writeBinding(id *ast.Ident, kind string, parent *spb.VName) *s
 	}
 	target := e.pi.ObjectVName(obj)
 	if kind != "" {
-		e.writeFact(target, facts.NodeKind, kind)
+		e.writeBindingKind(target, kind)
 	}
 	if id.Name != "_" {
 		e.writeRef(id, target, edges.DefinesBinding)
@@ -740,26 +1994,353 @@ func (e *emitter) writeBinding(id *ast.Ident, kind string, parent *spb.VName) *s
 	return target
 }
 
+// writeBindingKind emits the node kind fact for target, the target of a
+// binding, and passes it to the OnNode hook if one is set.
+func (e *emitter) writeBindingKind(target *spb.VName, kind string) {
+	e.writeFact(target, facts.NodeKind, kind)
+	if e.opts != nil && e.opts.OnNode != nil {
+		e.opts.OnNode(target, kind)
+	}
+}
+
 // writeDef emits a spanning anchor and defines edge for the specified node.
 // This function does not create the target node.
 func (e *emitter) writeDef(node ast.Node, target *spb.VName) { e.writeRef(node, target, edges.Defines) }
 
+// writeFieldDef emits a defines anchor spanning the declaration of a struct
+// field, and associates the field's documentation with target. This is a
+// no-op if target == nil.
+func (e *emitter) writeFieldDef(field *ast.Field, target *spb.VName) {
+	if target != nil {
+		e.writeDef(field, target)
+		e.writeDoc(field.Doc, target)
+	}
+}
+
+// writeComplexity emits the cyclomatic complexity of the function with the
+// given body, if enabled by the options.
+func (e *emitter) writeComplexity(fn *spb.VName, body *ast.BlockStmt) {
+	if e.opts != nil && e.opts.EmitComplexity {
+		e.writeFact(fn, factComplexity, strconv.Itoa(cyclomaticComplexity(body)))
+	}
+}
+
+// errorType is the type of the predeclared error interface.
+var errorType = types.Universe.Lookup("error").Type().Underlying().(*types.Interface)
+
+// writeReturnsError marks the function with the given signature if its last
+// result satisfies the error interface, if enabled by the options.  The value
+// of the fact is the type of that result, which is "error" in the common case.
+func (e *emitter) writeReturnsError(fn *spb.VName, sig *types.Signature) {
+	if e.opts == nil || !e.opts.EmitReturnsError {
+		return
+	}
+	results := sig.Results()
+	if n := results.Len(); n > 0 {
+		if last := results.At(n - 1).Type(); types.Implements(last, errorType) {
+			e.writeFact(fn, factReturnsError, types.TypeString(last, types.RelativeTo(e.pi.Package)))
+		}
+	}
+}
+
+// writeArity emits the numbers of parameters and results of the function with
+// the given signature, if enabled by the options.
+func (e *emitter) writeArity(fn *spb.VName, sig *types.Signature) {
+	if e.opts != nil && e.opts.EmitArity {
+		e.writeFact(fn, factParamCount, strconv.Itoa(sig.Params().Len()))
+		e.writeFact(fn, factResultCount, strconv.Itoa(sig.Results().Len()))
+	}
+}
+
+// writeCoverageTarget marks the function declared by decl in file as a target
+// for coverage, with the range of lines it spans, if enabled by the options.
+// Functions without bodies, and those in test files or generated files, are
+// not coverage targets.
+func (e *emitter) writeCoverageTarget(file *ast.File, fn *spb.VName, decl *ast.FuncDecl) {
+	if e.opts == nil || !e.opts.EmitCoverageTargets || decl.Body == nil {
+		return
+	}
+	start := e.pi.FileSet.Position(decl.Pos())
+	if strings.HasSuffix(start.Filename, "_test.go") || isGenerated(file) {
+		return
+	}
+	end := e.pi.FileSet.Position(decl.End())
+	e.writeFact(fn, factCoverLines, fmt.Sprintf("%d-%d", start.Line, end.Line))
+}
+
 // writeDoc adds associations between comment groups and a documented node.
 func (e *emitter) writeDoc(comments *ast.CommentGroup, target *spb.VName) {
 	if comments == nil || len(comments.List) == 0 || target == nil {
 		return
 	}
+	e.emitDocLinks(comments)
+	if e.opts != nil && e.opts.SkipDocNodes {
+		return
+	}
 	var lines []string
 	for _, comment := range comments.List {
 		lines = append(lines, trimComment(comment.Text))
 	}
+	text := strings.Join(lines, "\n")
+	if e.opts != nil && e.opts.DocNodeTransform != nil {
+		text = e.opts.DocNodeTransform(target, text)
+	}
+	switch e.opts.docFormat() {
+	case Raw:
+	case Markdown:
+		text = markdownDoc(text)
+	default:
+		text = escComment.Replace(text)
+	}
 	docNode := proto.Clone(target).(*spb.VName)
 	docNode.Signature += " doc"
-	e.writeFact(docNode, facts.NodeKind, nodes.Doc)
-	e.writeFact(docNode, facts.Text, strings.Join(lines, "\n"))
+	e.writeNode(docNode, nodeFact{facts.NodeKind, nodes.Doc}, nodeFact{facts.Text, text})
 	e.writeEdge(docNode, target, edges.Documents)
 }
 
+// docLink matches a doc link in a comment: a bracketed name, which may be
+// qualified by the name of an imported package, a type, or both, for example
+// [Name], [T.Method], [io.Reader], or [io.Reader.Read].  A leading "*" is
+// permitted, as in [*bytes.Buffer].
+var docLink = regexp.MustCompile(`\[\*?([\pL_][\pL\pN_]*(?:\.[\pL_][\pL\pN_]*){0,2})\]`)
+
+// emitDocLinks emits a reference from each name in the doc links of comments
+// to what it denotes, if that can be resolved.  Names are resolved in package
+// scope, or, if qualified by the name of a package imported by the file, in
+// the scope of that package; the package name is itself a reference to the
+// package.  Brackets followed by ":" or "(" are link definitions or Markdown
+// links rather than doc links, and are skipped.
+func (e *emitter) emitDocLinks(comments *ast.CommentGroup) {
+	if e.docLinks[comments] {
+		return // already handled for another declaration sharing comments
+	}
+	if e.docLinks == nil {
+		e.docLinks = make(map[*ast.CommentGroup]bool)
+	}
+	e.docLinks[comments] = true
+
+	var imports map[string]*types.PkgName
+	for _, c := range comments.List {
+		file, base, _ := e.pi.Span(c)
+		for _, loc := range docLink.FindAllStringSubmatchIndex(c.Text, -1) {
+			if end := loc[1]; end < len(c.Text) && (c.Text[end] == ':' || c.Text[end] == '(') {
+				continue
+			}
+			if imports == nil {
+				imports = e.fileImports(file)
+			}
+			parts := strings.Split(c.Text[loc[2]:loc[3]], ".")
+			targets := e.resolveDocLink(parts, imports)
+			start := base + loc[2]
+			for i, part := range parts {
+				if i < len(targets) && targets[i] != nil {
+					anchor := e.writeSpan(file, start, start+len(part))
+					e.writeEdge(anchor, targets[i], edges.Ref)
+				}
+				start += len(part) + 1 // skip the "."
+			}
+		}
+	}
+}
+
+// fileImports returns the package names declared by the imports of file,
+// keyed by name.
+func (e *emitter) fileImports(file *ast.File) map[string]*types.PkgName {
+	imports := make(map[string]*types.PkgName)
+	for _, spec := range file.Imports {
+		if pkg := e.importName(spec); pkg != nil {
+			imports[pkg.Name()] = pkg
+		}
+	}
+	return imports
+}
+
+// importName returns the package name declared by spec, or nil if there is
+// none.
+func (e *emitter) importName(spec *ast.ImportSpec) *types.PkgName {
+	var obj types.Object
+	if spec.Name != nil {
+		obj = e.pi.Info.Defs[spec.Name]
+	} else {
+		obj = e.pi.Info.Implicits[spec]
+	}
+	pkg, _ := obj.(*types.PkgName)
+	return pkg
+}
+
+// resolveDocLink returns the vnames of what each of the dot-separated parts of
+// a doc link denotes, in order.  The result may be shorter than parts, and has
+// nil entries, for parts that do not resolve.  A qualifier that names both a
+// type of this package and an imported package is taken to be the type.
+func (e *emitter) resolveDocLink(parts []string, imports map[string]*types.PkgName) []*spb.VName {
+	var targets []*spb.VName
+	scope := e.pi.Package.Scope()
+	if name := imports[parts[0]]; name != nil && len(parts) > 1 {
+		if _, ok := scope.Lookup(parts[0]).(*types.TypeName); !ok {
+			pkg := name.Imported()
+			if dep := e.pi.Dependencies[pkg.Path()]; dep != nil {
+				pkg = dep
+			}
+			e.pkgUses[name] |= docUse
+			targets = append(targets, e.pi.PackageVName[pkg])
+			scope = pkg.Scope()
+			parts = parts[1:]
+		}
+	}
+	obj := scope.Lookup(parts[0])
+	if obj == nil {
+		return targets
+	}
+	targets = append(targets, e.pi.ObjectVName(obj))
+	if tname, ok := obj.(*types.TypeName); ok && len(parts) == 2 {
+		if sel, _, _ := types.LookupFieldOrMethod(tname.Type(), true, tname.Pkg(), parts[1]); sel != nil {
+			targets = append(targets, e.pi.ObjectVName(sel))
+		}
+	}
+	return targets
+}
+
+// todoMarker matches the markers of comments noting work to be done.
+var todoMarker = regexp.MustCompile(`\b(?:TODO|FIXME|BUG)\b`)
+
+// emitTodos emits a diagnostic node for each TODO, FIXME, or BUG marker in the
+// comments of file.  The message of each diagnostic is the text from the
+// marker to the end of its line, or to the next marker if that comes first.
+func (e *emitter) emitTodos(file *ast.File) {
+	for _, group := range file.Comments {
+		var owner *spb.VName // found once the group is known to have a marker
+		for _, c := range group.List {
+			locs := todoMarker.FindAllStringIndex(c.Text, -1)
+			if len(locs) == 0 {
+				continue
+			} else if owner == nil {
+				owner = e.todoOwner(file, group)
+			}
+			_, base, _ := e.pi.Span(c)
+			for i, loc := range locs {
+				text := c.Text[loc[0]:]
+				if i+1 < len(locs) {
+					text = c.Text[loc[0]:locs[i+1][0]]
+				}
+				if eol := strings.IndexByte(text, '\n'); eol >= 0 {
+					text = text[:eol]
+				}
+				text = strings.TrimSpace(strings.TrimSuffix(strings.TrimSpace(text), "*/"))
+
+				start := base + loc[0]
+				end := start + len(text)
+				anchor := e.writeSpan(file, start, end)
+
+				diag := e.writeDiagnostic(anchor, "todo", text)
+				e.writeEdge(owner, diag, edges.Tagged)
+			}
+		}
+	}
+}
+
+// writeDiagnostic emits a diagnostic node with the given message, tagged by
+// anchor, and returns its vname.  The signature of the diagnostic is that of
+// the anchor followed by the given tag, which distinguishes the kinds of
+// diagnostic that may be attached to the same anchor.
+func (e *emitter) writeDiagnostic(anchor *spb.VName, tag, message string) *spb.VName {
+	diag := proto.Clone(anchor).(*spb.VName)
+	diag.Signature += " " + tag
+	if e.isHidden(anchor) {
+		return diag
+	}
+	e.writeNode(diag, nodeFact{facts.NodeKind, nodes.Diagnostic}, nodeFact{facts.Message, message})
+	e.writeEdge(anchor, diag, edges.Tagged)
+	return diag
+}
+
+// todoOwner returns the vname of the innermost function, type, or value
+// declaration of file that encloses or documents group, or the package vname
+// if there is none.
+func (e *emitter) todoOwner(file *ast.File, group *ast.CommentGroup) *spb.VName {
+	owner := e.pi.VName
+	ast.Inspect(file, func(node ast.Node) bool {
+		if node == nil {
+			return false
+		}
+		start := node.Pos()
+		switch n := node.(type) {
+		case *ast.FuncDecl:
+			if n.Doc != nil {
+				start = n.Doc.Pos()
+			}
+		case *ast.GenDecl:
+			if n.Doc != nil {
+				start = n.Doc.Pos()
+			}
+		case *ast.TypeSpec:
+			if n.Doc != nil {
+				start = n.Doc.Pos()
+			}
+		case *ast.ValueSpec:
+			if n.Doc != nil {
+				start = n.Doc.Pos()
+			}
+		}
+		if group.Pos() < start || group.End() > node.End() {
+			return false
+		}
+
+		switch n := node.(type) {
+		case *ast.FuncDecl, *ast.FuncLit:
+			if info := e.pi.function[n]; info != nil {
+				owner = info.vname
+			}
+		case *ast.TypeSpec:
+			if obj := e.pi.Info.Defs[n.Name]; obj != nil {
+				owner = e.pi.ObjectVName(obj)
+			}
+		case *ast.ValueSpec:
+			for _, id := range n.Names {
+				if obj := e.pi.Info.Defs[id]; obj != nil && id.Name != "_" {
+					owner = e.pi.ObjectVName(obj)
+					break
+				}
+			}
+		}
+		return true
+	})
+	return owner
+}
+
+// cyclomaticComplexity returns the cyclomatic complexity of a function with
+// the given body, which is one more than the number of decision points in the
+// body: if, for, and range statements, non-default case and select clauses,
+// and the && and || operators. Function literals within body are not counted,
+// since they are functions in their own right.
+func cyclomaticComplexity(body *ast.BlockStmt) int {
+	n := 1
+	if body == nil {
+		return n // an external function, e.g., implemented in assembly
+	}
+	ast.Inspect(body, func(node ast.Node) bool {
+		switch t := node.(type) {
+		case *ast.FuncLit:
+			return false
+		case *ast.IfStmt, *ast.ForStmt, *ast.RangeStmt:
+			n++
+		case *ast.CaseClause:
+			if t.List != nil {
+				n++
+			}
+		case *ast.CommClause:
+			if t.Comm != nil {
+				n++
+			}
+		case *ast.BinaryExpr:
+			if t.Op == token.LAND || t.Op == token.LOR {
+				n++
+			}
+		}
+		return true
+	})
+	return n
+}
+
 // isCall reports whether id is a call to obj.  This holds if id is in call
 // position ("id(...") or is the RHS of a selector in call position
 // ("x.id(...)"). If so, the nearest enclosing call expression is also
@@ -789,22 +2370,52 @@ func (e *emitter) callContext(stack stackFunc) *funcInfo {
 		case *ast.FuncDecl, *ast.FuncLit:
 			return e.pi.function[p]
 		case nil:
-			if e.pi.packageInit == nil {
-				// Lazily emit a virtual node to represent the static
-				// initializer for top-level expressions in the package.  We
-				// only do this if there are expressions that need to be
-				// initialized.
-				vname := proto.Clone(e.pi.VName).(*spb.VName)
-				vname.Signature += ".<init>"
-				e.pi.packageInit = &funcInfo{vname: vname}
-				e.writeFact(vname, facts.NodeKind, nodes.Function)
-				e.writeEdge(vname, e.pi.VName, edges.ChildOf)
-			}
-			return e.pi.packageInit
+			return e.packageInit()
 		}
 	}
 }
 
+// packageInit returns funcInfo for the virtual function that represents the
+// static initializer for top-level expressions in the package.  The node for
+// this function is emitted lazily, the first time it is needed, so that it is
+// only present if there is something to be initialized.
+func (e *emitter) packageInit() *funcInfo {
+	if e.pi.packageInit == nil {
+		vname := proto.Clone(e.pi.VName).(*spb.VName)
+		vname.Signature += ".<init>"
+		e.pi.packageInit = &funcInfo{vname: vname}
+		e.writeFact(vname, facts.NodeKind, nodes.Function)
+		e.writeEdge(vname, e.pi.VName, edges.ChildOf)
+	}
+	return e.pi.packageInit
+}
+
+// enclosingFuncType returns the type of the nearest enclosing function
+// declaration or literal, not including the node itself, or nil if there is
+// none.
+func enclosingFuncType(stack stackFunc) *ast.FuncType {
+	for i := 1; ; i++ {
+		switch p := stack(i).(type) {
+		case *ast.FuncDecl:
+			return p.Type
+		case *ast.FuncLit:
+			return p.Type
+		case nil:
+			return nil
+		}
+	}
+}
+
+// isFuncBody reports whether the block at the top of the stack is the body of
+// a function declaration or literal.
+func isFuncBody(stack stackFunc) bool {
+	switch stack(1).(type) {
+	case *ast.FuncDecl, *ast.FuncLit:
+		return true
+	}
+	return false
+}
+
 // nameContext returns the vname for the nearest enclosing parent node, not
 // including the node itself, or the enclosing package vname if the node is at
 // the top level.
@@ -872,6 +2483,9 @@ func (w *astVisitor) Visit(node ast.Node) ast.Visitor {
 
 	w.stack = append(w.stack, node) // push
 	if !w.visit(node, w.parent) {
+		// The walk does not report the end of a node whose children are
+		// skipped, so pop it here.
+		w.stack = w.stack[:len(w.stack)-1]
 		return nil
 	}
 	return w
@@ -905,18 +2519,103 @@ func mapFields(fields *ast.FieldList, f func(i int, id *ast.Ident)) {
 	}
 }
 
+// generatedHeader matches the comment that marks a file as generated code, per
+// https://golang.org/s/generatedcode.
+var generatedHeader = regexp.MustCompile(`^// Code generated .* DO NOT EDIT\.$`)
+
+// isGenerated reports whether file is marked as generated code, by a header
+// comment preceding its package clause.
+func isGenerated(file *ast.File) bool {
+	for _, group := range file.Comments {
+		if group.Pos() > file.Package {
+			break
+		}
+		for _, c := range group.List {
+			if generatedHeader.MatchString(c.Text) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
 var escComment = strings.NewReplacer("[", `\[`, "]", `\]`, `\`, `\\`)
 
 // trimComment removes the comment delimiters from a comment.  For single-line
 // comments, it also removes a single leading space, if present; for multi-line
-// comments it discards leading and trailing whitespace. Brackets and backslash
-// characters are escaped per http://www.kythe.io/docs/schema/#doc.
+// comments it discards leading and trailing whitespace.
 func trimComment(text string) string {
 	if single := strings.TrimPrefix(text, "//"); single != text {
-		return escComment.Replace(strings.TrimPrefix(single, " "))
+		return strings.TrimPrefix(single, " ")
+	}
+	return strings.TrimSpace(strings.TrimSuffix(strings.TrimPrefix(text, "/*"), "*/"))
+}
+
+// markdownDoc converts the text of a doc comment to Markdown.  Each run of
+// indented lines is fenced as a code block with its common indentation
+// removed; all other lines are passed through unchanged.
+func markdownDoc(text string) string {
+	lines := strings.Split(text, "\n")
+	var out []string
+	for i := 0; i < len(lines); {
+		if !isIndented(lines[i]) {
+			out = append(out, lines[i])
+			i++
+			continue
+		}
+
+		// Find the end of the code block, which may contain blank lines.
+		end := i + 1
+		for j := end; j < len(lines); j++ {
+			if isIndented(lines[j]) {
+				end = j + 1
+			} else if strings.TrimSpace(lines[j]) != "" {
+				break
+			}
+		}
+		block := lines[i:end]
+		indent := commonIndent(block)
+
+		if len(out) > 0 && out[len(out)-1] != "" {
+			out = append(out, "")
+		}
+		out = append(out, "```")
+		for _, line := range block {
+			out = append(out, strings.TrimPrefix(line, indent))
+		}
+		out = append(out, "```")
+		if end < len(lines) && lines[end] != "" {
+			out = append(out, "")
+		}
+		i = end
+	}
+	return strings.Join(out, "\n")
+}
+
+// isIndented reports whether line is a non-blank line beginning with
+// whitespace.
+func isIndented(line string) bool {
+	return strings.TrimSpace(line) != "" && (line[0] == ' ' || line[0] == '\t')
+}
+
+// commonIndent returns the longest whitespace prefix shared by all the
+// non-blank lines.
+func commonIndent(lines []string) string {
+	var indent string
+	first := true
+	for _, line := range lines {
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		lead := line[:len(line)-len(strings.TrimLeft(line, " \t"))]
+		if first {
+			indent, first = lead, false
+		}
+		for !strings.HasPrefix(lead, indent) {
+			indent = indent[:len(indent)-1]
+		}
 	}
-	trimmed := strings.TrimSpace(strings.TrimSuffix(strings.TrimPrefix(text, "/*"), "*/"))
-	return escComment.Replace(trimmed)
+	return indent
 }
 
 // specComment returns the innermost comment associated with spec, or nil.
@@ -17,18 +17,126 @@
 package indexer
 
 import (
+	"compress/gzip"
 	"context"
-	"strconv"
+	"fmt"
+	"io"
+	"strings"
 
-	"kythe.io/kythe/go/util/schema/facts"
-	"kythe.io/kythe/go/util/schema/nodes"
+	"kythe.io/kythe/go/platform/delimited"
 
 	spb "kythe.io/kythe/proto/storage_proto"
 )
 
+// Facts emitted by the Go indexer that are not part of the core Kythe schema.
+// Except where noted, these are emitted only by optional features.
+const (
+	factComplexity   = "/kythe/go/complexity"   // cyclomatic complexity of a function
+	factCoverLines   = "/kythe/go/coverlines"   // lines "start-end" of a function that is a coverage target
+	factDigest       = "/kythe/go/digest"       // SHA-256 digest of a file's text
+	factImportUse    = "/kythe/go/importuse"    // "type-only" or "doc-only" for an import not used in code (always emitted)
+	factParamCount   = "/kythe/go/paramcount"   // number of a function's parameters, excluding any receiver
+	factResultCount  = "/kythe/go/resultcount"  // number of a function's results
+	factReturnsError = "/kythe/go/returnserror" // type of a function's error result
+	factRuneEnd      = "/kythe/go/runeend"      // end of an anchor, in runes
+	factRuneStart    = "/kythe/go/runestart"    // start of an anchor, in runes
+)
+
+// Values of factImportUse, which marks the anchor of an import whose package
+// name is used only to qualify types, or only in doc links.
+const (
+	importTypeOnly = "type-only"
+	importDocOnly  = "doc-only"
+)
+
+// Edges emitted by the Go indexer that are not part of the core Kythe schema.
+// Except where noted, these are emitted only by optional features.
+const (
+	edgeDefinedFrom       = "/kythe/edge/go/definedfrom"        // defined type → type named in its definition (always emitted)
+	edgeAssertedSatisfies = "/kythe/edge/go/satisfies/asserted" // type → interface asserted by a blank variable
+	edgeAssignsResult     = "/kythe/edge/go/assignsresult"      // returned expression anchor → named result variable
+	edgeEmbeds            = "/kythe/edge/go/embeds"             // variable → file embedded by a //go:embed directive (always emitted)
+	edgeImplementedBy     = "/kythe/edge/go/implementedby"      // abstract method → concrete method
+	edgeInitOrder         = "/kythe/edge/go/initorder"          // package initializer → variable or init function (ordinal)
+	edgeLinkname          = "/kythe/edge/go/linkname"           // declaration → symbol it is linked to by a //go:linkname directive (always emitted)
+	edgeMatchesError      = "/kythe/edge/go/matcheserror"       // errors.As call anchor → type of error matched by its target
+	edgeMethodOrigin      = "/kythe/edge/go/methodorigin"       // interface method → interface that declares it
+	edgeMethodSet         = "/kythe/edge/go/methodset"          // interface type → method in its flattened method set
+	edgePromotes          = "/kythe/edge/go/promotes"           // struct type → method promoted from an embedded interface
+	edgeReads             = "/kythe/edge/go/ref/reads"          // element read anchor → indexed variable
+	edgeSatisfiesIn       = "/kythe/edge/go/satisfiesin"        // concrete method → interface it implements a method of
+	edgeSpreads           = "/kythe/edge/go/spreads"            // spread argument anchor → variadic parameter
+	edgeUsesPackage       = "/kythe/edge/go/usespackage"        // function → imported package it refers to by name
+	edgeWrites            = "/kythe/edge/go/ref/writes"         // element write anchor → indexed variable
+)
+
 // A Sink is a callback invoked by the indexer to deliver entries.
 type Sink func(context.Context, *spb.Entry) error
 
+// A NodeSink is a callback invoked by the indexer to deliver all the facts of
+// a node at once, keyed by fact name.  A sink that sends entries in batches,
+// for example over RPC, can use one to make a single call for each such node
+// rather than one call for each fact.
+type NodeSink func(ctx context.Context, src *spb.VName, values map[string]string) error
+
+// A nodeFact is a single fact of a node, written by writeNode.
+type nodeFact struct{ name, value string }
+
+// TeeSink returns a Sink that delivers each entry to each of the given sinks
+// in turn.  An error from one sink does not prevent delivery to the rest; if
+// any of the sinks fail, the error returned reports all their errors.
+func TeeSink(sinks ...Sink) Sink {
+	return func(ctx context.Context, entry *spb.Entry) error {
+		var errs []error
+		for _, sink := range sinks {
+			if err := sink(ctx, entry); err != nil {
+				errs = append(errs, err)
+			}
+		}
+		switch len(errs) {
+		case 0:
+			return nil
+		case 1:
+			return errs[0]
+		}
+		msgs := make([]string, len(errs))
+		for i, err := range errs {
+			msgs[i] = err.Error()
+		}
+		return fmt.Errorf("%d of %d sinks failed: %s", len(errs), len(sinks), strings.Join(msgs, "; "))
+	}
+}
+
+// A WriterSink writes entries to an io.Writer as a stream of length-delimited
+// wire-format protobuf messages, which can be read by a delimited.Reader.  Its
+// Write method is a Sink.
+type WriterSink struct {
+	w     *delimited.Writer
+	close func() error // completes the stream, if necessary
+}
+
+// NewWriterSink returns a WriterSink that writes entries to w.
+func NewWriterSink(w io.Writer) *WriterSink { return &WriterSink{w: delimited.NewWriter(w)} }
+
+// NewGzipWriterSink returns a WriterSink that writes a gzip-compressed stream
+// of entries to w.  The stream is incomplete until the sink is closed.
+func NewGzipWriterSink(w io.Writer) *WriterSink {
+	gz := gzip.NewWriter(w)
+	return &WriterSink{w: delimited.NewWriter(gz), close: gz.Close}
+}
+
+// Write writes entry to the stream.
+func (s *WriterSink) Write(_ context.Context, entry *spb.Entry) error { return s.w.PutProto(entry) }
+
+// Close flushes and completes the stream, if it is compressed.  It does not
+// close the underlying writer.
+func (s *WriterSink) Close() error {
+	if s.close != nil {
+		return s.close()
+	}
+	return nil
+}
+
 // writeFact writes a single fact with the given name and value for src to s.
 func (s Sink) writeFact(ctx context.Context, src *spb.VName, name, value string) error {
 	return s(ctx, &spb.Entry{
@@ -48,13 +156,12 @@ func (s Sink) writeEdge(ctx context.Context, src, tgt *spb.VName, kind string) e
 	})
 }
 
-// writeAnchor emits an anchor with the given offsets to s.
-func (s Sink) writeAnchor(ctx context.Context, src *spb.VName, start, end int) error {
-	if err := s.writeFact(ctx, src, facts.NodeKind, nodes.Anchor); err != nil {
-		return err
-	}
-	if err := s.writeFact(ctx, src, facts.AnchorStart, strconv.Itoa(start)); err != nil {
-		return err
+// writeNode writes each of the facts of the node src to s, in order.
+func (s Sink) writeNode(ctx context.Context, src *spb.VName, fs []nodeFact) error {
+	for _, f := range fs {
+		if err := s.writeFact(ctx, src, f.name, f.value); err != nil {
+			return err
+		}
 	}
-	return s.writeFact(ctx, src, facts.AnchorEnd, strconv.Itoa(end))
+	return nil
 }
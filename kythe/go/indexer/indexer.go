@@ -119,11 +119,19 @@ type PackageInfo struct {
 
 	// The Go-specific details from the compilation record.
 	details *gopb.GoDetails
+
+	// The vnames of required inputs that are neither source files nor
+	// packages, such as files embedded by //go:embed directives.
+	dataFiles []*spb.VName
 }
 
 type funcInfo struct {
 	vname    *spb.VName
 	numAnons int // number of anonymous functions defined inside this one
+
+	// The imported packages referred to by name in this function, for which
+	// a package-use edge has been emitted.  Lazily initialized.
+	usedPkgs map[*types.Package]bool
 }
 
 // packageImporter implements the types.Importer interface by fetching files
@@ -217,8 +225,9 @@ func Resolve(unit *apb.CompilationUnit, f Fetcher, opts *ResolveOptions) (*Packa
 	floc := make(map[*token.File]*ast.File) // file → ast
 	fset := token.NewFileSet()              // location info for the parser
 	details := goDetails(unit)
-	var files []*ast.File // parsed sources
-	var rules []*Ruleset  // parsed linkage rules
+	var files []*ast.File      // parsed sources
+	var rules []*Ruleset       // parsed linkage rules
+	var dataFiles []*spb.VName // other inputs, neither sources nor packages
 
 	// Classify the required inputs as either sources, which are to be parsed,
 	// or dependencies, which are to be "imported" via the type-checker's
@@ -292,6 +301,13 @@ func Resolve(unit *apb.CompilationUnit, f Fetcher, opts *ResolveOptions) (*Packa
 		ipath := vnameToImport(ri.VName, details.GetGoroot())
 		imap[ipath] = ri.VName
 		fmap[ipath] = ri.Info
+		if ri.VName.Signature == "" {
+			vname := proto.Clone(ri.VName).(*spb.VName)
+			if vname.Path == "" {
+				vname.Path = fpath
+			}
+			dataFiles = append(dataFiles, vname)
+		}
 	}
 	if len(files) == 0 {
 		return nil, errors.New("no source files in package")
@@ -322,6 +338,7 @@ func Resolve(unit *apb.CompilationUnit, f Fetcher, opts *ResolveOptions) (*Packa
 		fileVName: filev,
 		fileLoc:   floc,
 		details:   details,
+		dataFiles: dataFiles,
 	}
 
 	// If mapping rules were found, populate the corresponding field.
@@ -404,6 +421,29 @@ func (pi *PackageInfo) Signature(obj types.Object) string {
 	return sig
 }
 
+// assignInitSignatures overrides the normal signature generation for the
+// package-level init functions of pi to include a discriminator, since there
+// may be several of them. The discriminators are assigned in source order
+// over all the files of the package, so that the signatures do not depend on
+// which files are emitted or in what order.
+func (pi *PackageInfo) assignInitSignatures() {
+	if pi.numInits != 0 {
+		return // already assigned
+	}
+	for _, file := range pi.Files {
+		for _, decl := range file.Decls {
+			fd, ok := decl.(*ast.FuncDecl)
+			if !ok || fd.Recv != nil || fd.Name.Name != "init" {
+				continue
+			}
+			if obj, _ := pi.Info.Defs[fd.Name].(*types.Func); obj != nil {
+				pi.numInits++
+				pi.sigs[obj] = fmt.Sprintf("%s#%d", pi.Signature(obj), pi.numInits)
+			}
+		}
+	}
+}
+
 // ObjectVName returns a VName for obj relative to that of its package.
 func (pi *PackageInfo) ObjectVName(obj types.Object) *spb.VName {
 	if pkg, ok := obj.(*types.PkgName); ok {
@@ -651,7 +691,7 @@ const (
 // user-defined names, fields from methods, and so on.  The base is a unique
 // name for obj within its package, modulo the tag.
 func (pi *PackageInfo) newSignature(obj types.Object) (tag, base string) {
-	if obj.Name() == "" {
+	if _, ok := obj.(*types.Var); obj.Name() == "" && !ok {
 		return tagVar, "_"
 	}
 	topLevelTag := tagVar
@@ -680,7 +720,7 @@ func (pi *PackageInfo) newSignature(obj types.Object) (tag, base string) {
 			return tagField, fmt.Sprintf("[%p].%s", t, t.Name())
 		} else if owner, ok := pi.owner[t]; ok {
 			_, base := pi.newSignature(owner)
-			return tagParam, base + ":" + t.Name()
+			return tagParam, base + ":" + paramName(owner, t)
 		}
 
 	case *types.Func:
@@ -730,11 +770,36 @@ func (pi *PackageInfo) newSignature(obj types.Object) (tag, base string) {
 	return topLevelTag, fmt.Sprintf("[%p].%s", obj, obj.Name())
 }
 
+// paramName returns the name of v, a parameter, result, or receiver of the
+// function or function-typed field owner, for use in its signature.  Blank and
+// unnamed parameters and results are named for their positions instead, so
+// that each has a distinct signature: "_0" for the first parameter and "_r0"
+// for the first result.
+func paramName(owner types.Object, v *types.Var) string {
+	if name := v.Name(); name != "" && name != "_" {
+		return name
+	}
+	if sig, ok := owner.Type().Underlying().(*types.Signature); ok {
+		for i := 0; i < sig.Params().Len(); i++ {
+			if sig.Params().At(i) == v {
+				return "_" + strconv.Itoa(i)
+			}
+		}
+		for i := 0; i < sig.Results().Len(); i++ {
+			if sig.Results().At(i) == v {
+				return "_r" + strconv.Itoa(i)
+			}
+		}
+	}
+	return "_"
+}
+
 // addOwners updates pi.owner from the types in pkg, adding mapping from fields
 // of package-level named struct types to the owning named struct type; from
 // methods of package-level named interface types to the owning named interface
-// type; and from parameters of package-level named function or method types to
-// the owning named function or method.
+// type; from parameters of function-typed fields of those struct types to the
+// owning field; and from parameters of package-level named function or method
+// types to the owning named function or method.
 //
 // This relation is used to construct signatures for these fields/methods,
 // since they may be referenced from another package and thus need
@@ -807,6 +872,9 @@ func (pi *PackageInfo) addOwners(pkg *types.Package) {
 					if _, ok := pi.owner[f]; !ok {
 						pi.owner[f] = obj
 					}
+					if fsig, ok := f.Type().(*types.Signature); ok {
+						pi.addParamOwners(fsig, f)
+					}
 				}
 			case *types.Interface:
 				// Inspect the declared methods of an interface.
@@ -827,15 +895,19 @@ func (pi *PackageInfo) addOwners(pkg *types.Package) {
 			if recv := fsig.Recv(); recv != nil {
 				pi.owner[recv] = obj
 			}
-			if params := fsig.Params(); params != nil {
-				for i := 0; i < params.Len(); i++ {
-					pi.owner[params.At(i)] = obj
-				}
-			}
-			if res := fsig.Results(); res != nil {
-				for i := 0; i < res.Len(); i++ {
-					pi.owner[res.At(i)] = obj
-				}
+			pi.addParamOwners(fsig, obj)
+		}
+	}
+}
+
+// addParamOwners updates pi.owner with a mapping from each parameter and
+// result value of fsig to owner, unless one is already recorded.  The same
+// parameters may be shared by several fields declared together.
+func (pi *PackageInfo) addParamOwners(fsig *types.Signature, owner types.Object) {
+	for _, tuple := range []*types.Tuple{fsig.Params(), fsig.Results()} {
+		for i := 0; i < tuple.Len(); i++ {
+			if v := tuple.At(i); pi.owner[v] == nil {
+				pi.owner[v] = owner
 			}
 		}
 	}
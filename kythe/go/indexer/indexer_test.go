@@ -17,22 +17,35 @@
 package indexer
 
 import (
+	"bytes"
+	"compress/gzip"
 	"context"
 	"crypto/sha256"
 	"encoding/hex"
+	"errors"
 	"fmt"
 	"go/ast"
 	"go/token"
+	"io"
 	"io/ioutil"
+	"net/url"
 	"os"
 	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
 	"testing"
+	"unicode/utf8"
 
 	"github.com/golang/protobuf/proto"
 
+	"kythe.io/kythe/go/platform/delimited"
 	"kythe.io/kythe/go/test/testutil"
 	"kythe.io/kythe/go/util/metadata"
 	"kythe.io/kythe/go/util/ptypes"
+	"kythe.io/kythe/go/util/schema/edges"
+	"kythe.io/kythe/go/util/schema/facts"
+	"kythe.io/kythe/go/util/schema/nodes"
 
 	apb "kythe.io/kythe/proto/analysis_proto"
 	gopb "kythe.io/kythe/proto/go_proto"
@@ -317,6 +330,123 @@ func TestSink(t *testing.T) {
 	}
 }
 
+// countingSink returns a Sink that counts the facts and edges delivered to it.
+func countingSink(numFacts, numEdges *int) Sink {
+	return func(_ context.Context, e *spb.Entry) error {
+		if isEdge(e) {
+			*numEdges++
+		} else {
+			*numFacts++
+		}
+		return nil
+	}
+}
+
+func TestTeeSink(t *testing.T) {
+	const input = `package pkg
+
+type T struct{ N int }
+
+func (t T) Get() int { return t.N }
+`
+	unit, digest := oneFileCompilation("testfile/source.go", "pkg", input)
+	pi, err := Resolve(unit, memFetcher{digest: input}, &ResolveOptions{Info: XRefTypeInfo()})
+	if err != nil {
+		t.Fatalf("Resolve failed: %v", err)
+	}
+
+	// Every sink should receive every entry, even though one of them fails.
+	var facts1, edges1, facts2, edges2, failures int
+	failing := func(context.Context, *spb.Entry) error {
+		failures++
+		return errors.New("bad sink")
+	}
+	sink := TeeSink(countingSink(&facts1, &edges1), failing, countingSink(&facts2, &edges2))
+	if err := pi.Emit(context.Background(), sink, nil); err == nil {
+		t.Error("Emit to a failing sink: got no error, wanted one")
+	} else if !strings.Contains(err.Error(), "bad sink") {
+		t.Errorf("Emit to a failing sink: unexpected error: %v", err)
+	}
+
+	if facts1 == 0 || edges1 == 0 {
+		t.Errorf("First sink: got %d facts and %d edges, wanted some of each", facts1, edges1)
+	}
+	if facts2 != facts1 || edges2 != edges1 {
+		t.Errorf("Last sink: got %d facts, %d edges; want %d, %d", facts2, edges2, facts1, edges1)
+	}
+	if want := facts1 + edges1; failures != want {
+		t.Errorf("Failing sink: got %d entries, want %d", failures, want)
+	}
+
+	// Errors from several sinks are all reported.
+	err = TeeSink(failing, countingSink(&facts1, &edges1), failing)(context.Background(), &spb.Entry{})
+	if err == nil || strings.Count(err.Error(), "bad sink") != 2 {
+		t.Errorf("Tee of two failing sinks: got error %v, want both reported", err)
+	}
+}
+
+func TestWriterSink(t *testing.T) {
+	const input = `package pkg
+
+type T struct{ N int }
+
+func (t T) Get() int { return t.N }
+`
+	unit, digest := oneFileCompilation("testfile/source.go", "pkg", input)
+	pi, err := Resolve(unit, memFetcher{digest: input}, &ResolveOptions{Info: XRefTypeInfo()})
+	if err != nil {
+		t.Fatalf("Resolve failed: %v", err)
+	}
+
+	tests := []struct {
+		name   string
+		sink   func(io.Writer) *WriterSink
+		reader func(io.Reader) (io.Reader, error)
+	}{
+		{"plain", NewWriterSink, func(r io.Reader) (io.Reader, error) { return r, nil }},
+		{"gzip", NewGzipWriterSink, func(r io.Reader) (io.Reader, error) { return gzip.NewReader(r) }},
+	}
+	for _, test := range tests {
+		var buf bytes.Buffer
+		var want []*spb.Entry
+		ws := test.sink(&buf)
+		collect := func(_ context.Context, e *spb.Entry) error {
+			want = append(want, e)
+			return nil
+		}
+		if err := pi.Emit(context.Background(), TeeSink(collect, ws.Write), nil); err != nil {
+			t.Fatalf("Emit to %s sink failed: %v", test.name, err)
+		} else if err := ws.Close(); err != nil {
+			t.Fatalf("Closing %s sink failed: %v", test.name, err)
+		}
+
+		r, err := test.reader(&buf)
+		if err != nil {
+			t.Fatalf("Reading %s stream failed: %v", test.name, err)
+		}
+		rd := delimited.NewReader(r)
+		var got []*spb.Entry
+		for {
+			var entry spb.Entry
+			if err := rd.NextProto(&entry); err == io.EOF {
+				break
+			} else if err != nil {
+				t.Fatalf("Reading %s entry %d failed: %v", test.name, len(got), err)
+			}
+			got = append(got, &entry)
+		}
+		if len(got) != len(want) || len(want) == 0 {
+			t.Errorf("Entries read from %s sink: got %d, want %d", test.name, len(got), len(want))
+			continue
+		}
+		for i, entry := range got {
+			if !proto.Equal(entry, want[i]) {
+				t.Errorf("Entry %d read from %s sink: got %+v, want %+v", i, test.name, entry, want[i])
+			}
+		}
+	}
+}
+
 func TestComments(t *testing.T) {
 	// Verify that comment text is correctly escaped when translated into
 	// documentation nodes.
@@ -411,5 +541,1828 @@ func TestRules(t *testing.T) {
 	}
 }
 
+func TestEmitFile(t *testing.T) {
+	// Verify that emitting a single file produces the same anchors as the
+	// corresponding portion of the whole package, including the signatures of
+	// init functions, which are numbered across the package.
+	const alpha = `package p
+
+func init() { A() }
+
+func A() {}
+`
+	const bravo = `package p
+
+var b = 1
+
+func init() { A(); b++ }
+`
+	unit, alphaDigest := oneFileCompilation("alpha.go", "p", alpha)
+	u2, bravoDigest := oneFileCompilation("bravo.go", "p", bravo)
+	unit.RequiredInput = append(unit.RequiredInput, u2.RequiredInput...)
+	unit.SourceFile = append(unit.SourceFile, u2.SourceFile...)
+	fetcher := memFetcher{alphaDigest: alpha, bravoDigest: bravo}
+
+	// anchorEdges returns the edges from anchors in the named file, in a
+	// format suitable for comparison.
+	anchorEdges := func(pi *PackageInfo, path string, emit func(Sink) error) []string {
+		var out []string
+		if err := emit(func(_ context.Context, e *spb.Entry) error {
+			if isEdge(e) && e.Source.Path == path && strings.HasPrefix(e.Source.Signature, "#") {
+				out = append(out, fmt.Sprintf("%s %s %s", e.Source.Signature, e.EdgeKind, e.Target.Signature))
+			}
+			return nil
+		}); err != nil {
+			t.Fatalf("Emit failed: %v", err)
+		}
+		sort.Strings(out)
+		return out
+	}
+
+	for i, path := range []string{"alpha.go", "bravo.go"} {
+		// Resolve separately for each, so that state cached by the package
+		// from one emission cannot affect the other.
+		pi, err := Resolve(unit, fetcher, &ResolveOptions{Info: XRefTypeInfo()})
+		if err != nil {
+			t.Fatalf("Resolve failed: %v\nInput unit:\n%s", err, proto.MarshalTextString(unit))
+		}
+		file := pi.Files[i]
+		got := anchorEdges(pi, path, func(sink Sink) error {
+			return pi.EmitFile(context.Background(), sink, nil, file)
+		})
+
+		pi, err = Resolve(unit, fetcher, &ResolveOptions{Info: XRefTypeInfo()})
+		if err != nil {
+			t.Fatalf("Resolve failed: %v", err)
+		}
+		want := anchorEdges(pi, path, func(sink Sink) error {
+			return pi.Emit(context.Background(), sink, nil)
+		})
+
+		if len(got) == 0 {
+			t.Errorf("EmitFile(%q): no anchors emitted", path)
+		}
+		if err := testutil.DeepEqual(want, got); err != nil {
+			t.Errorf("EmitFile(%q): %v", path, err)
+		}
+	}
+
+	// A file that does not belong to the package is rejected.
+	pi, err := Resolve(unit, fetcher, nil)
+	if err != nil {
+		t.Fatalf("Resolve failed: %v", err)
+	}
+	if err := pi.EmitFile(context.Background(), nil, nil, &ast.File{}); err == nil {
+		t.Error("EmitFile with a foreign file: got no error, wanted one")
+	}
+}
+
+// emitSource resolves a package consisting of a single file with the given
+// source text, and returns the entries emitted for it with the given options.
+func emitSource(t *testing.T, src string, opts *EmitOptions) []*spb.Entry {
+	unit, digest := oneFileCompilation("testfile/source.go", "pkg", src)
+	pi, err := Resolve(unit, memFetcher{digest: src}, &ResolveOptions{Info: XRefTypeInfo()})
+	if err != nil {
+		t.Fatalf("Resolve failed: %v\nInput unit:\n%s", err, proto.MarshalTextString(unit))
+	}
+	var entries []*spb.Entry
+	if err := pi.Emit(context.Background(), func(_ context.Context, e *spb.Entry) error {
+		entries = append(entries, e)
+		return nil
+	}, opts); err != nil {
+		t.Fatalf("Emit unexpectedly failed: %v", err)
+	}
+	return entries
+}
+
+// hasEdge reports whether entries include an edge of the given kind from src.
+func hasEdge(entries []*spb.Entry, src *spb.VName, kind string) bool {
+	for _, e := range entries {
+		if isEdge(e) && e.EdgeKind == kind && proto.Equal(e.Source, src) {
+			return true
+		}
+	}
+	return false
+}
+
+// findFact returns the value of the named fact for the node with the given
+// signature, and reports whether it was found.
+func findFact(entries []*spb.Entry, signature, name string) (string, bool) {
+	for _, e := range entries {
+		if !isEdge(e) && e.Source.Signature == signature && e.FactName == name {
+			return string(e.FactValue), true
+		}
+	}
+	return "", false
+}
+
+func TestAnchorsWrittenOnce(t *testing.T) {
+	// The positional initializer x is both a ref to the variable and a
+	// ref/init of the field, from the same anchor.
+	const input = `package pkg
+
+type T struct{ F int }
+
+var x = 1
+
+var v = T{x}
+`
+	entries := emitSource(t, input, nil)
+	start := strconv.Itoa(strings.LastIndex(input, "x"))
+
+	var anchor string
+	for _, e := range entries {
+		if !isEdge(e) && e.FactName == facts.AnchorStart && string(e.FactValue) == start {
+			anchor = e.Source.Signature
+		}
+	}
+	if anchor == "" {
+		t.Fatalf("No anchor found starting at offset %s", start)
+	}
+
+	kinds := make(map[string]int)
+	var nodeKinds int
+	for _, e := range entries {
+		if e.Source.Signature != anchor {
+			continue
+		} else if isEdge(e) {
+			kinds[e.EdgeKind]++
+		} else if e.FactName == facts.NodeKind {
+			nodeKinds++
+		}
+	}
+	if kinds[edges.Ref] != 1 || kinds[edges.RefInit] != 1 {
+		t.Errorf("Edges from anchor %q: got %v, want one each of %s and %s", anchor, kinds, edges.Ref, edges.RefInit)
+	}
+	if nodeKinds != 1 {
+		t.Errorf("Anchor %q: got %d node kind facts, want 1", anchor, nodeKinds)
+	}
+}
+
+func TestUnresolvedImports(t *testing.T) {
+	const input = `package pkg
+
+import "example.com/missing/lib"
+
+var _ = lib.Value
+`
+	start := strconv.Itoa(strings.Index(input, `"example.com`))
+
+	for _, placeholder := range []bool{false, true} {
+		entries := emitSource(t, input, &EmitOptions{PlaceholderImports: placeholder})
+
+		// Find the anchor spanning the import path.
+		var anchor string
+		for _, e := range entries {
+			if !isEdge(e) && e.FactName == facts.AnchorStart && string(e.FactValue) == start {
+				anchor = e.Source.Signature
+			}
+		}
+		if anchor == "" {
+			t.Fatalf("Placeholder %v: no anchor found for the import path", placeholder)
+		}
+
+		diags := findEdges(entries, anchor, edges.Tagged)
+		if len(diags) != 1 {
+			t.Errorf("Placeholder %v: got diagnostics %+q, want 1", placeholder, diags)
+		} else if msg, _ := findFact(entries, diags[0], facts.Message); !strings.Contains(msg, "example.com/missing/lib") {
+			t.Errorf("Placeholder %v: diagnostic message %q does not name the import", placeholder, msg)
+		}
+
+		var imports []*spb.VName
+		for _, e := range entries {
+			if isEdge(e) && e.Source.Signature == anchor && e.EdgeKind == edges.RefImports {
+				imports = append(imports, e.Target)
+			}
+		}
+		if !placeholder {
+			if len(imports) != 0 {
+				t.Errorf("Import refs without the option: got %+v, want none", imports)
+			}
+			continue
+		}
+		want := &spb.VName{Corpus: "example.com", Path: "missing/lib", Signature: "package", Language: "go"}
+		if len(imports) != 1 || !proto.Equal(imports[0], want) {
+			t.Errorf("Import refs with placeholders: got %+v, want %+v", imports, want)
+		}
+	}
+}
+
+func TestKeywordAnchors(t *testing.T) {
+	const input = `package pkg
+
+type T int
+
+func f(xs []int) int {
+	for range xs {
+	}
+	return 0
+}
+`
+	tests := []struct {
+		keyword, parent string
+	}{
+		{"type", "type T"},
+		{"func", "func f"},
+		{"range", "func f"},
+		{"return", "func f"},
+	}
+
+	entries := emitSource(t, input, &EmitOptions{EmitKeywordAnchors: true})
+	for _, test := range tests {
+		start := strings.Index(input, test.keyword)
+		anchor := fmt.Sprintf("#%d:%d", start, start+len(test.keyword))
+
+		var got []string
+		for _, e := range entries {
+			if isEdge(e) && e.Source.Signature == anchor {
+				got = append(got, e.EdgeKind+" "+e.Target.Signature)
+			}
+		}
+		want := []string{edges.ChildOf + " " + test.parent}
+		if err := testutil.DeepEqual(want, got); err != nil {
+			t.Errorf("Edges from %q keyword anchor %s: %v", test.keyword, anchor, err)
+		}
+	}
+
+	start := strings.Index(input, "func")
+	funcAnchor := fmt.Sprintf("#%d:%d", start, start+len("func"))
+	for _, e := range emitSource(t, input, nil) {
+		if e.Source.Signature == funcAnchor {
+			t.Errorf("Keyword anchor without the option: %+v", e)
+		}
+	}
+}
+
+func TestDefinedFrom(t *testing.T) {
+	const input = `package pkg
+
+type Celsius float64
+
+type Kelvin Celsius
+
+type Point struct{ X, Y int }
+
+type Paren (Point)
+`
+	tests := []struct {
+		signature string
+		want      []string
+	}{
+		{"type Celsius", []string{"builtin-type float64"}},
+		{"type Kelvin", []string{"type Celsius"}},
+		{"type Point", nil},
+		{"type Paren", []string{"type Point"}},
+	}
+	entries := emitSource(t, input, nil)
+	for _, test := range tests {
+		if err := testutil.DeepEqual(test.want, findEdges(entries, test.signature, edgeDefinedFrom)); err != nil {
+			t.Errorf("Definition of %q: %v", test.signature, err)
+		}
+	}
+}
+
+func TestAssertedSatisfactions(t *testing.T) {
+	const input = `package pkg
+
+type Shape interface{ Area() int }
+
+type Square int
+
+func (Square) Area() int { return 0 }
+
+type Circle struct{}
+
+func (*Circle) Area() int { return 0 }
+
+type Blob struct{}
+
+func (Blob) Area() int { return 0 }
+
+var _ Shape = Square(0)
+var _ Shape = (*Circle)(nil)
+
+var shape Shape = Blob{}
+
+func f() {
+	var _ Shape = Blob{}
+}
+`
+	tests := []struct {
+		signature string
+		want      []string
+	}{
+		{"type Square", []string{"type Shape"}},
+		{"type Circle", []string{"type Shape"}},
+		{"type Blob", nil}, // not asserted by a package-level blank variable
+	}
+	entries := emitSource(t, input, &EmitOptions{EmitAssertedSatisfactions: true})
+	for _, test := range tests {
+		if err := testutil.DeepEqual(test.want, findEdges(entries, test.signature, edgeAssertedSatisfies)); err != nil {
+			t.Errorf("Asserted satisfactions of %q: %v", test.signature, err)
+		}
+	}
+
+	// Asserted satisfactions are reported only when requested.
+	if got := findEdges(emitSource(t, input, nil), "type Square", edgeAssertedSatisfies); len(got) != 0 {
+		t.Errorf("Asserted satisfactions without the option: got %q, want none", got)
+	}
+}
+
+func TestComplexity(t *testing.T) {
+	const input = `package pkg
+
+func simple() {}
+
+func branchy(xs []int) int {
+	n := 0
+	if len(xs) == 0 {
+		return n
+	}
+	for _, x := range xs {
+		if x > 0 && x < 10 {
+			n++
+		}
+	}
+	f := func() {
+		if n > 5 {
+			n = 5
+		}
+	}
+	f()
+	switch n {
+	case 1, 2:
+		n = 0
+	default:
+	}
+	return n
+}
+`
+	for _, test := range []struct {
+		opts       *EmitOptions
+		fn, want   string
+		wantExists bool
+	}{
+		{&EmitOptions{EmitComplexity: true}, "func simple", "1", true},
+		// if, range, if, &&, case.
+		{&EmitOptions{EmitComplexity: true}, "func branchy", "6", true},
+		{&EmitOptions{EmitComplexity: true}, "func branchy$1", "2", true},
+		{nil, "func branchy", "", false},
+	} {
+		entries := emitSource(t, input, test.opts)
+		got, ok := findFact(entries, test.fn, factComplexity)
+		if ok != test.wantExists || got != test.want {
+			t.Errorf("Complexity of %q with options %+v: got (%q, %v), want (%q, %v)",
+				test.fn, test.opts, got, ok, test.want, test.wantExists)
+		}
+	}
+}
+
+func TestFileDigests(t *testing.T) {
+	const input = "package pkg\n"
+	const want = "a7b92614d2024fe2c230fc2384eb004c430483cd4ce7c7c12aeed66e69342a07"
+
+	if got, ok := findFact(emitSource(t, input, &EmitOptions{EmitFileDigests: true}), "", factDigest); got != want {
+		t.Errorf("File digest: got %q, %v; want %q", got, ok, want)
+	}
+	if got, ok := findFact(emitSource(t, input, nil), "", factDigest); ok {
+		t.Errorf("File digest without the option: got %q, want none", got)
+	}
+}
+
+func TestReturnsError(t *testing.T) {
+	const input = `package pkg
+
+type myErr struct{}
+
+func (*myErr) Error() string { return "" }
+
+func open() (int, error) { return 0, nil }
+func check() *myErr { return nil }
+func count() int { return 0 }
+func swap() (error, int) { return nil, 0 }
+
+var f = func() error { return nil }
+`
+	entries := emitSource(t, input, &EmitOptions{EmitReturnsError: true})
+	tests := []struct {
+		signature, want string
+	}{
+		{"func open", "error"},
+		{"func check", "*myErr"},
+		{"func count", ""},
+		{"func swap", ""},
+		{"package.<init>$1", "error"},
+	}
+	for _, test := range tests {
+		if got, _ := findFact(entries, test.signature, factReturnsError); got != test.want {
+			t.Errorf("Error result of %q: got %q, want %q", test.signature, got, test.want)
+		}
+	}
+
+	if got, ok := findFact(emitSource(t, input, nil), "func open", factReturnsError); ok {
+		t.Errorf("Error result without the option: got %q, want none", got)
+	}
+}
+
+func TestArity(t *testing.T) {
+	const input = `package pkg
+
+type T struct{}
+
+func (t *T) Method(a int, b string) error { return nil }
+
+func none() {}
+
+func variadic(format string, args ...interface{}) (n int, err error) { return 0, nil }
+
+var f = func(x, y, z int) {}
+`
+	entries := emitSource(t, input, &EmitOptions{EmitArity: true})
+	tests := []struct {
+		signature       string
+		params, results string
+	}{
+		{"method (*test/pkg.T).Method", "2", "1"}, // the receiver is not a parameter
+		{"func none", "0", "0"},
+		{"func variadic", "2", "2"},
+		{"package.<init>$1", "3", "0"},
+	}
+	for _, test := range tests {
+		if got, _ := findFact(entries, test.signature, factParamCount); got != test.params {
+			t.Errorf("Parameter count of %q: got %q, want %q", test.signature, got, test.params)
+		}
+		if got, _ := findFact(entries, test.signature, factResultCount); got != test.results {
+			t.Errorf("Result count of %q: got %q, want %q", test.signature, got, test.results)
+		}
+	}
+
+	if got, ok := findFact(emitSource(t, input, nil), "func none", factParamCount); ok {
+		t.Errorf("Parameter count without the option: got %q, want none", got)
+	}
+}
+
+func TestCoverageTargets(t *testing.T) {
+	const input = `package pkg
+
+type T struct{}
+
+// Method has a doc comment, which is not covered.
+func (t *T) Method() int {
+	return 0
+}
+
+func oneLine() {}
+
+func external()
+`
+	opts := &EmitOptions{EmitCoverageTargets: true}
+	entries := emitSource(t, input, opts)
+	tests := []struct {
+		signature, want string
+	}{
+		{"method (*test/pkg.T).Method", "6-8"},
+		{"func oneLine", "10-10"},
+		{"func external", ""}, // no body
+	}
+	for _, test := range tests {
+		if got, _ := findFact(entries, test.signature, factCoverLines); got != test.want {
+			t.Errorf("Coverage lines of %q: got %q, want %q", test.signature, got, test.want)
+		}
+	}
+
+	if got, ok := findFact(emitSource(t, input, nil), "func oneLine", factCoverLines); ok {
+		t.Errorf("Coverage lines without the option: got %q, want none", got)
+	}
+
+	const generated = "// Code generated by hand. DO NOT EDIT.\n\npackage pkg\n\nfunc f() {}\n"
+	if got, ok := findFact(emitSource(t, generated, opts), "func f", factCoverLines); ok {
+		t.Errorf("Coverage lines in a generated file: got %q, want none", got)
+	}
+
+	const test = "package pkg\n\nfunc f() {}\n"
+	unit, digest := oneFileCompilation("testfile/source_test.go", "pkg", test)
+	pi, err := Resolve(unit, memFetcher{digest: test}, &ResolveOptions{Info: XRefTypeInfo()})
+	if err != nil {
+		t.Fatalf("Resolve failed: %v", err)
+	}
+	if err := pi.Emit(context.Background(), func(_ context.Context, e *spb.Entry) error {
+		if e.FactName == factCoverLines {
+			t.Errorf("Coverage lines in a test file: got %q for %q, want none", e.FactValue, e.Source.Signature)
+		}
+		return nil
+	}, opts); err != nil {
+		t.Fatalf("Emit failed: %v", err)
+	}
+}
+
+func TestEmbeds(t *testing.T) {
+	const input = `package pkg
+
+//go:embed version.txt
+var version string
+
+//go:embed static templates/*.tmpl "with space.txt"
+var assets []byte
+
+// Everything includes hidden files.
+//go:embed all:static
+var everything []byte
+
+var notEmbedded string
+`
+	unit, digest := oneFileCompilation("testfile/source.go", "pkg", input)
+	for _, path := range []string{
+		"testfile/static/a.txt",
+		"testfile/static/_hidden.txt",
+		"testfile/static/sub/b.css",
+		"testfile/templates/x.tmpl",
+		"testfile/templates/y.html",
+		"other/static/c.txt",
+	} {
+		unit.RequiredInput = append(unit.RequiredInput, &apb.CompilationUnit_FileInput{
+			VName: &spb.VName{Corpus: "test", Path: path},
+			Info:  &apb.FileInfo{Path: path},
+		})
+	}
+	pi, err := Resolve(unit, memFetcher{digest: input}, &ResolveOptions{Info: XRefTypeInfo()})
+	if err != nil {
+		t.Fatalf("Resolve failed: %v", err)
+	}
+	embeds := make(map[string][]string) // :: variable → embedded paths
+	if err := pi.Emit(context.Background(), func(_ context.Context, e *spb.Entry) error {
+		if e.EdgeKind == edgeEmbeds {
+			embeds[e.Source.Signature] = append(embeds[e.Source.Signature], e.Target.Path)
+		}
+		return nil
+	}, nil); err != nil {
+		t.Fatalf("Emit failed: %v", err)
+	}
+
+	want := map[string][]string{
+		"var version": {"testfile/version.txt"},
+		"var assets": {
+			"testfile/static/a.txt",
+			"testfile/static/sub/b.css",
+			"testfile/templates/x.tmpl",
+			"testfile/with space.txt",
+		},
+		"var everything": {
+			"testfile/static/_hidden.txt",
+			"testfile/static/a.txt",
+			"testfile/static/sub/b.css",
+		},
+	}
+	if err := testutil.DeepEqual(want, embeds); err != nil {
+		t.Errorf("Embedded files: %v", err)
+	}
+}
+
+func TestBlankParams(t *testing.T) {
+	const input = `package pkg
+
+func f(_ int, x string) {}
+
+func g(int, string) {}
+
+func h(_, _ int) {}
+`
+	entries := emitSource(t, input, nil)
+	tests := []struct {
+		signature string
+		want      []string // the target of each parameter edge, in order
+	}{
+		{"func f", []string{"param f:_0", "param f:x"}},
+		{"func g", []string{"param g:_0", "param g:_1"}},
+		{"func h", []string{"param h:_0", "param h:_1"}},
+	}
+	for _, test := range tests {
+		var got []string
+		for i := range test.want {
+			got = append(got, findEdges(entries, test.signature, edges.ParamIndex(i))...)
+		}
+		if err := testutil.DeepEqual(test.want, got); err != nil {
+			t.Errorf("Parameters of %q: %v", test.signature, err)
+		}
+		for _, param := range test.want {
+			if err := testutil.DeepEqual([]string{test.signature}, findEdges(entries, param, edges.ChildOf)); err != nil {
+				t.Errorf("Parent of %q: %v", param, err)
+			}
+		}
+	}
+}
+
+func TestInitFuncValues(t *testing.T) {
+	const input = `package pkg
+
+type T struct{}
+
+func (T) Method() {}
+
+func serve() {}
+
+func helper() func() { return serve }
+
+var handler = serve
+var method = T{}.Method
+var called = helper()
+var wrapped = func() { _ = serve }
+`
+	// Collect the signatures of the targets of anchors blamed on the package
+	// initializer, by the kind of edge from the anchor.
+	blamed := func(entries []*spb.Entry) map[string][]string {
+		parents := make(map[string]string) // :: anchor signature → parent
+		for _, e := range entries {
+			if e.EdgeKind == edges.ChildOf && strings.HasPrefix(e.Source.Signature, "#") {
+				parents[e.Source.Signature] = e.Target.Signature
+			}
+		}
+		targets := make(map[string][]string)
+		for _, e := range entries {
+			if isEdge(e) && e.EdgeKind != edges.ChildOf && parents[e.Source.Signature] == "package.<init>" {
+				targets[e.EdgeKind] = append(targets[e.EdgeKind], e.Target.Signature)
+			}
+		}
+		for _, ts := range targets {
+			sort.Strings(ts)
+		}
+		return targets
+	}
+
+	want := map[string][]string{
+		edges.Ref:     {"func serve", "method (test/pkg.T).Method"},
+		edges.RefCall: {"func helper"},
+	}
+	if err := testutil.DeepEqual(want, blamed(emitSource(t, input, &EmitOptions{EmitInitFuncValues: true}))); err != nil {
+		t.Errorf("Blamed on the package initializer: %v", err)
+	}
+
+	// Without the option, only calls are blamed.
+	want = map[string][]string{
+		edges.RefCall: {"func helper"},
+	}
+	if err := testutil.DeepEqual(want, blamed(emitSource(t, input, nil))); err != nil {
+		t.Errorf("Blamed on the package initializer without the option: %v", err)
+	}
+}
+
+func TestSpanRemap(t *testing.T) {
+	const input = `package pkg
+
+var x = 1
+
+func f() int { return x }
+`
+	// anchors returns the vname signatures of the anchors in entries, checking
+	// that each agrees with the offsets of the anchor.
+	anchors := func(entries []*spb.Entry) []string {
+		starts := make(map[string]string)
+		ends := make(map[string]string)
+		for _, e := range entries {
+			switch e.FactName {
+			case facts.AnchorStart:
+				starts[e.Source.Signature] = string(e.FactValue)
+			case facts.AnchorEnd:
+				ends[e.Source.Signature] = string(e.FactValue)
+			}
+		}
+		var sigs []string
+		for sig, start := range starts {
+			if want := "#" + start + ":" + ends[sig]; sig != want {
+				t.Errorf("Anchor %q has offsets %s", sig, want)
+			}
+			sigs = append(sigs, sig)
+		}
+		sort.Strings(sigs)
+		return sigs
+	}
+
+	const shift = 100
+	var files []string
+	remapped := anchors(emitSource(t, input, &EmitOptions{
+		SpanRemap: func(file *spb.VName, start, end int) (int, int) {
+			files = append(files, file.Path)
+			return start + shift, end + shift
+		},
+	}))
+	original := anchors(emitSource(t, input, nil))
+
+	var want []string
+	for _, sig := range original {
+		var start, end int
+		if _, err := fmt.Sscanf(sig, "#%d:%d", &start, &end); err != nil {
+			t.Fatalf("Invalid anchor signature %q: %v", sig, err)
+		}
+		want = append(want, fmt.Sprintf("#%d:%d", start+shift, end+shift))
+	}
+	sort.Strings(want)
+	if err := testutil.DeepEqual(want, remapped); err != nil {
+		t.Errorf("Remapped anchors: %v", err)
+	}
+	for _, file := range files {
+		if file != "testfile/source.go" {
+			t.Errorf("Remapped a span of file %q, want testfile/source.go", file)
+		}
+	}
+}
+
+func TestPackageUses(t *testing.T) {
+	foo, err := readTestFile("testdata/foo.a")
+	if err != nil {
+		t.Fatalf("Unable to read foo.a: %v", err)
+	}
+	const input = `package bar
+
+import "test/foo"
+
+func uses() int { return foo.Foo() }
+
+func usesTwice() int { return foo.Foo() + foo.Foo() }
+
+func unused() int { return 0 }
+
+var v = foo.Foo()
+`
+	unit, digest := oneFileCompilation("testdata/bar.go", "bar", input)
+	unit.RequiredInput = append(unit.RequiredInput, &apb.CompilationUnit_FileInput{
+		VName: &spb.VName{Language: "go", Corpus: "test", Path: "foo", Signature: "package"},
+		Info:  &apb.FileInfo{Path: "testdata/foo.a", Digest: hexDigest(foo)},
+	})
+	fetcher := memFetcher{
+		hexDigest(foo): string(foo),
+		digest:         input,
+	}
+	pi, err := Resolve(unit, fetcher, &ResolveOptions{Info: XRefTypeInfo()})
+	if err != nil {
+		t.Fatalf("Resolve failed: %v", err)
+	}
+	var entries []*spb.Entry
+	if err := pi.Emit(context.Background(), func(_ context.Context, e *spb.Entry) error {
+		entries = append(entries, e)
+		return nil
+	}, &EmitOptions{EmitPackageUses: true}); err != nil {
+		t.Fatalf("Emit failed: %v", err)
+	}
+
+	tests := []struct {
+		signature string
+		want      []string
+	}{
+		{"func uses", []string{"package"}},
+		{"func usesTwice", []string{"package"}}, // one edge per package
+		{"func unused", nil},
+		{"package.<init>", []string{"package"}},
+	}
+	for _, test := range tests {
+		if err := testutil.DeepEqual(test.want, findEdges(entries, test.signature, edgeUsesPackage)); err != nil {
+			t.Errorf("Packages used by %q: %v", test.signature, err)
+		}
+	}
+	for _, e := range entries {
+		if e.EdgeKind == edgeUsesPackage && e.Target.Path != "foo" {
+			t.Errorf("Package use edge to %+v, want test/foo", e.Target)
+		}
+	}
+}
+
+// findEdges returns the signatures of the targets of all the edges of the
+// given kind from the node with the given signature, in sorted order.
+func findEdges(entries []*spb.Entry, signature, kind string) []string {
+	var targets []string
+	for _, e := range entries {
+		if isEdge(e) && e.Source.Signature == signature && e.EdgeKind == kind {
+			targets = append(targets, e.Target.Signature)
+		}
+	}
+	sort.Strings(targets)
+	return targets
+}
+
+func TestImplementations(t *testing.T) {
+	const input = `package pkg
+
+type Shape interface { Area() int }
+
+type square struct{}
+func (square) Area() int { return 4 }
+
+type circle struct{}
+func (circle) Area() int { return 3 }
+`
+	const abstract = "method Shape.Area"
+	want := []string{"method (test/pkg.circle).Area", "method (test/pkg.square).Area"}
+
+	got := findEdges(emitSource(t, input, &EmitOptions{EmitImplementations: true}), abstract, edgeImplementedBy)
+	if err := testutil.DeepEqual(want, got); err != nil {
+		t.Errorf("Implementations of %q: %v", abstract, err)
+	}
+	if got := findEdges(emitSource(t, input, nil), abstract, edgeImplementedBy); len(got) != 0 {
+		t.Errorf("Implementations of %q without the option: got %+q, want none", abstract, got)
+	}
+}
+
+func TestMethodInterfaces(t *testing.T) {
+	const input = `package pkg
+
+type Writer interface{ Write() }
+
+type WriteCloser interface {
+	Write()
+	Close()
+}
+
+type File struct{}
+
+func (File) Write() {}
+func (File) Close() {}
+
+type Buffer struct{}
+
+func (*Buffer) Write() {}
+func (Buffer) Reset()  {}
+
+type Partial struct{}
+
+func (Partial) Close() {}
+`
+	entries := emitSource(t, input, &EmitOptions{EmitMethodInterfaces: true})
+	tests := []struct {
+		method string
+		want   []string
+	}{
+		{"method (test/pkg.File).Write", []string{"type WriteCloser", "type Writer"}},
+		{"method (test/pkg.File).Close", []string{"type WriteCloser"}},
+		{"method (*test/pkg.Buffer).Write", []string{"type Writer"}},
+		{"method (test/pkg.Buffer).Reset", nil},
+		{"method (test/pkg.Partial).Close", nil}, // Partial satisfies neither
+	}
+	for _, test := range tests {
+		if err := testutil.DeepEqual(test.want, findEdges(entries, test.method, edgeSatisfiesIn)); err != nil {
+			t.Errorf("Interfaces of %q: %v", test.method, err)
+		}
+	}
+
+	for _, e := range emitSource(t, input, nil) {
+		if isEdge(e) && e.EdgeKind == edgeSatisfiesIn {
+			t.Errorf("Method interface edge without the option: %+v", e)
+		}
+	}
+}
+
+func TestPromotions(t *testing.T) {
+	const input = `package pkg
+
+type Reader interface { Read([]byte) (int, error) }
+
+type base struct{}
+func (base) Close() error { return nil }
+
+type wrapper struct {
+	Reader
+	base
+}
+func (wrapper) Name() string { return "" }
+
+type outer struct{ *wrapper }
+`
+	tests := []struct {
+		signature string
+		want      []string
+	}{
+		{"type wrapper", []string{"method Reader.Read"}},
+		{"type outer", []string{"method Reader.Read"}},
+		{"type base", nil},
+	}
+	entries := emitSource(t, input, &EmitOptions{EmitPromotions: true})
+	for _, test := range tests {
+		got := findEdges(entries, test.signature, edgePromotes)
+		if err := testutil.DeepEqual(test.want, got); err != nil {
+			t.Errorf("Promotions from %q: %v", test.signature, err)
+		}
+	}
+	if got := findEdges(emitSource(t, input, nil), "type wrapper", edgePromotes); len(got) != 0 {
+		t.Errorf("Promotions without the option: got %+q, want none", got)
+	}
+}
+
+func TestMethodSets(t *testing.T) {
+	const input = `package pkg
+
+type A interface { AMethod() }
+
+type C interface {
+	A
+	B()
+}
+`
+	entries := emitSource(t, input, &EmitOptions{EmitMethodSets: true})
+	tests := []struct {
+		signature, kind string
+		want            []string
+	}{
+		{"type A", edgeMethodSet, []string{"method A.AMethod"}},
+		{"type C", edgeMethodSet, []string{"method A.AMethod", "method C.B"}},
+		{"method A.AMethod", edgeMethodOrigin, []string{"type A"}},
+		{"method C.B", edgeMethodOrigin, []string{"type C"}},
+	}
+	for _, test := range tests {
+		got := findEdges(entries, test.signature, test.kind)
+		if err := testutil.DeepEqual(test.want, got); err != nil {
+			t.Errorf("Edges %s from %q: %v", test.kind, test.signature, err)
+		}
+	}
+	if got := findEdges(emitSource(t, input, nil), "type C", edgeMethodSet); len(got) != 0 {
+		t.Errorf("Method set without the option: got %+q, want none", got)
+	}
+}
+
+func TestErrorMatches(t *testing.T) {
+	// The test compilation cannot import the standard library, so it stands
+	// in for package errors itself.
+	const input = `package errors
+
+func As(err error, target interface{}) bool { return false }
+
+type MyError struct{}
+func (*MyError) Error() string { return "" }
+
+type ValueError struct{}
+func (ValueError) Error() string { return "" }
+
+func f(err error) {
+	var myErr *MyError
+	if As(err, &myErr) {
+	}
+	var valErr ValueError
+	As(err, &valErr)
+	var any interface{ Error() string }
+	As(err, &any)
+	var target interface{} = &myErr
+	As(err, target)
+}
+`
+	unit, digest := oneFileCompilation("testfile/errors.go", "errors", input)
+	pi, err := Resolve(unit, memFetcher{digest: input}, &ResolveOptions{Info: XRefTypeInfo()})
+	if err != nil {
+		t.Fatalf("Resolve failed: %v", err)
+	}
+	emit := func(opts *EmitOptions) (got []string) {
+		if err := pi.Emit(context.Background(), func(_ context.Context, e *spb.Entry) error {
+			if e.EdgeKind == edgeMatchesError {
+				got = append(got, e.Target.Signature)
+			}
+			return nil
+		}, opts); err != nil {
+			t.Fatalf("Emit failed: %v", err)
+		}
+		return got
+	}
+	if err := testutil.DeepEqual([]string{"type MyError", "type ValueError"}, emit(&EmitOptions{EmitErrorMatches: true})); err != nil {
+		t.Errorf("Error matches: %v", err)
+	}
+	if got := emit(nil); len(got) != 0 {
+		t.Errorf("Error matches without the option: got %+q, want none", got)
+	}
+}
+
+func TestSpreads(t *testing.T) {
+	const input = `package pkg
+
+func f(prefix string, rest ...int) {}
+
+func g(xs []int) {
+	f("a", xs...)
+	f("b", 1, 2)
+}
+`
+	entries := emitSource(t, input, &EmitOptions{EmitSpreads: true})
+	var got []string
+	for _, e := range entries {
+		if !isEdge(e) || e.EdgeKind != edgeSpreads {
+			continue
+		}
+		got = append(got, e.Target.Signature)
+
+		// The edge should come from an anchor spanning the spread argument.
+		want := strconv.Itoa(strings.Index(input, "xs..."))
+		if start, _ := findFact(entries, e.Source.Signature, facts.AnchorStart); start != want {
+			t.Errorf("Spread anchor start: got %q, want %q", start, want)
+		}
+	}
+	if err := testutil.DeepEqual([]string{"param f:rest"}, got); err != nil {
+		t.Errorf("Spread targets: %v", err)
+	}
+
+	for _, e := range emitSource(t, input, nil) {
+		if isEdge(e) && e.EdgeKind == edgeSpreads {
+			t.Errorf("Spread edge without the option: %+v", e)
+		}
+	}
+}
+
+func TestLinknames(t *testing.T) {
+	const input = `package pkg
+
+import _ "unsafe"
+
+//go:linkname nanotime runtime.nanotime
+func nanotime() int64
+
+//go:linkname alias test/pkg.target
+var alias int
+
+var target int
+
+//go:linkname pushed
+func pushed() {}
+
+//go:linkname remote example.com/lib.Remote
+var remote int
+`
+	entries := emitSource(t, input, nil)
+
+	links := make(map[string]string)
+	for _, e := range entries {
+		if isEdge(e) && e.EdgeKind == edgeLinkname {
+			links[e.Source.Signature] = fmt.Sprintf("%s %s %s", e.Target.Corpus, e.Target.Path, e.Target.Signature)
+		}
+	}
+	want := map[string]string{
+		"func nanotime": "golang.org runtime func nanotime",
+		"var alias":     "test pkg var target",
+		"var remote":    "example.com lib var Remote",
+	}
+	if err := testutil.DeepEqual(want, links); err != nil {
+		t.Errorf("Linkname edges: %v", err)
+	}
+
+	// Each name in a directive is a reference to what it names.
+	var refs []string
+	for _, e := range entries {
+		if !isEdge(e) || e.EdgeKind != edges.Ref {
+			continue
+		}
+		start, _ := findFact(entries, e.Source.Signature, facts.AnchorStart)
+		end, _ := findFact(entries, e.Source.Signature, facts.AnchorEnd)
+		i, _ := strconv.Atoi(start)
+		j, _ := strconv.Atoi(end)
+		if strings.HasPrefix(input[strings.LastIndex(input[:i], "\n")+1:], linknameDirective) {
+			refs = append(refs, input[i:j]+" "+e.Target.Signature)
+		}
+	}
+	sort.Strings(refs)
+	wantRefs := []string{
+		"alias var alias",
+		"example.com/lib.Remote var Remote",
+		"nanotime func nanotime",
+		"pushed func pushed",
+		"remote var remote",
+		"runtime.nanotime func nanotime",
+		"test/pkg.target var target",
+	}
+	if err := testutil.DeepEqual(wantRefs, refs); err != nil {
+		t.Errorf("Linkname references: %v", err)
+	}
+}
+
+func TestRuneOffsets(t *testing.T) {
+	const input = `package pkg
+
+// 日本語 😀
+var 名前 = "é😀"
+
+var after = 名前
+`
+	entries := emitSource(t, input, &EmitOptions{EmitRuneOffsets: true})
+
+	tests := []struct {
+		target string // signature of the variable bound
+		name   string // text of the binding anchor
+	}{
+		{"var 名前", "名前"},
+		{"var after", "after"},
+	}
+	for _, test := range tests {
+		var found bool
+		for _, e := range entries {
+			if !isEdge(e) || e.EdgeKind != edges.DefinesBinding || e.Target.Signature != test.target {
+				continue
+			}
+			found = true
+			start := strings.Index(input, "var "+test.name) + len("var ")
+			want := []string{
+				strconv.Itoa(utf8.RuneCountInString(input[:start])),
+				strconv.Itoa(utf8.RuneCountInString(input[:start+len(test.name)])),
+			}
+			runeStart, _ := findFact(entries, e.Source.Signature, factRuneStart)
+			runeEnd, _ := findFact(entries, e.Source.Signature, factRuneEnd)
+			if err := testutil.DeepEqual(want, []string{runeStart, runeEnd}); err != nil {
+				t.Errorf("Rune offsets of %q: %v", test.name, err)
+			}
+		}
+		if !found {
+			t.Errorf("No binding found for %q", test.target)
+		}
+	}
+
+	for _, e := range emitSource(t, input, nil) {
+		if e.FactName == factRuneStart || e.FactName == factRuneEnd {
+			t.Errorf("Rune offset fact without the option: %+v", e)
+		}
+	}
+}
+
+func TestEmitDeterministic(t *testing.T) {
+	// The entries for the satisfactions among types are derived from maps
+	// whose iteration order varies from one resolution to the next, so a
+	// package with several of them will expose any dependence on that order.
+	const first = `package pkg
+
+type Sayer interface{ Say() string }
+type Namer interface{ Name() string }
+type Both interface {
+	Sayer
+	Namer
+}
+
+type A struct{}
+
+func (A) Say() string  { return "a" }
+func (A) Name() string { return "a" }
+`
+	const second = `package pkg
+
+type B int
+
+func (B) Say() string   { return "b" }
+func (*B) Name() string { return "b" }
+
+type C struct{ A }
+
+type D struct{ B }
+`
+	u1, d1 := oneFileCompilation("first.go", "pkg", first)
+	u2, d2 := oneFileCompilation("second.go", "pkg", second)
+	u1.RequiredInput = append(u1.RequiredInput, u2.RequiredInput...)
+	u1.SourceFile = append(u1.SourceFile, u2.SourceFile...)
+	fetcher := memFetcher{d1: first, d2: second}
+
+	// emit returns the wire encoding of the entries emitted for a fresh
+	// resolution of the package, in order.
+	emit := func() []byte {
+		pi, err := Resolve(u1, fetcher, &ResolveOptions{Info: XRefTypeInfo()})
+		if err != nil {
+			t.Fatalf("Resolve failed: %v", err)
+		}
+		var buf bytes.Buffer
+		if err := pi.Emit(context.Background(), func(_ context.Context, e *spb.Entry) error {
+			bits, err := proto.Marshal(e)
+			buf.Write(bits)
+			return err
+		}, &EmitOptions{EmitImplementations: true, EmitMethodInterfaces: true}); err != nil {
+			t.Fatalf("Emit failed: %v", err)
+		}
+		return buf.Bytes()
+	}
+
+	want := emit()
+	for i := 0; i < 10; i++ {
+		if got := emit(); !bytes.Equal(got, want) {
+			t.Fatalf("Emit %d: output differs from the first (%d bytes vs. %d)", i+1, len(got), len(want))
+		}
+	}
+}
+
+func TestImportUses(t *testing.T) {
+	tests := []struct {
+		input, want string
+	}{
+		{`package pkg
+import "unsafe"
+var p unsafe.Pointer
+`, importTypeOnly},
+		{`package pkg
+import "unsafe"
+var p unsafe.Pointer
+var n = unsafe.Sizeof(p)
+`, ""},
+		{`package pkg
+import "unsafe"
+// F is like [unsafe.Pointer].
+func F() {}
+`, importDocOnly},
+		{`package pkg
+import u "unsafe"
+// F returns a [u.Pointer].
+func F() u.Pointer { return nil }
+`, importTypeOnly},
+		{`package pkg
+import _ "unsafe"
+`, ""},
+	}
+	for _, test := range tests {
+		entries := emitSource(t, test.input, nil)
+		var got []string
+		for _, e := range entries {
+			if !isEdge(e) && e.FactName == factImportUse {
+				got = append(got, string(e.FactValue))
+				if !hasEdge(entries, e.Source, edges.RefImports) {
+					t.Errorf("Import use %q is not on an import anchor: %+v", e.FactValue, e.Source)
+				}
+			}
+		}
+		var want []string
+		if test.want != "" {
+			want = []string{test.want}
+		}
+		if err := testutil.DeepEqual(want, got); err != nil {
+			t.Errorf("Import uses in:\n%s%v", test.input, err)
+		}
+	}
+}
+
+func TestNodeSink(t *testing.T) {
+	const input = `package pkg
+
+import "unsafe"
+
+// F does nothing.
+func F(p unsafe.Pointer) {}
+`
+	batches := make(map[string]map[string]string)
+	opts := &EmitOptions{
+		EmitArity: true,
+		NodeSink: func(_ context.Context, src *spb.VName, values map[string]string) error {
+			if _, ok := batches[src.Signature]; ok {
+				t.Errorf("NodeSink called more than once for %q", src.Signature)
+			}
+			batches[src.Signature] = values
+			return nil
+		},
+	}
+	entries := emitSource(t, input, opts)
+
+	// The facts of each node arrive in one call, and are not also delivered
+	// to the sink.
+	for _, e := range entries {
+		if !isEdge(e) {
+			t.Errorf("Fact %q of %q was delivered to the sink", e.FactName, e.Source.Signature)
+		}
+	}
+	if got := batches[""]; got["/kythe/node/kind"] != "file" || got["/kythe/text"] != input {
+		t.Errorf("NodeSink file facts: got %+q", got)
+	}
+	want := map[string]string{"/kythe/node/kind": "doc", "/kythe/text": "F does nothing."}
+	if err := testutil.DeepEqual(want, batches["func F doc"]); err != nil {
+		t.Errorf("NodeSink doc facts: %v", err)
+	}
+	want = map[string]string{"/kythe/node/kind": "function", factParamCount: "1", factResultCount: "0"}
+	if err := testutil.DeepEqual(want, batches["func F"]); err != nil {
+		t.Errorf("NodeSink function facts: %v", err)
+	}
+	var anchors, uses int
+	for _, values := range batches {
+		if values["/kythe/node/kind"] == "anchor" {
+			anchors++
+			if _, ok := values["/kythe/loc/end"]; !ok {
+				t.Errorf("NodeSink anchor facts: got %+q", values)
+			}
+			if values[factImportUse] == importTypeOnly {
+				uses++
+			}
+		}
+	}
+	if anchors == 0 || uses != 1 {
+		t.Errorf("NodeSink received %d anchors, %d with an import use; want some, 1", anchors, uses)
+	}
+
+	// Without a NodeSink, the same facts are delivered to the sink.
+	opts.NodeSink = nil
+	plain := make(map[string]map[string]string)
+	for _, e := range emitSource(t, input, opts) {
+		if !isEdge(e) {
+			if plain[e.Source.Signature] == nil {
+				plain[e.Source.Signature] = make(map[string]string)
+			}
+			plain[e.Source.Signature][e.FactName] = string(e.FactValue)
+		}
+	}
+	if err := testutil.DeepEqual(plain, batches); err != nil {
+		t.Errorf("Facts without NodeSink: %v", err)
+	}
+}
+
+func TestOnNode(t *testing.T) {
+	const input = `package pkg
+
+const limit = 3
+
+type T struct{ count int }
+
+type Doer interface{ Do() }
+
+type Name string
+
+func (t *T) Do() {}
+
+func f(n int) { x := n; _ = x }
+`
+	got := make(map[string][]string) // :: signature → kinds
+	entries := emitSource(t, input, &EmitOptions{
+		OnNode: func(vname *spb.VName, kind string) {
+			got[vname.Signature] = append(got[vname.Signature], kind)
+		},
+	})
+
+	want := map[string][]string{
+		"const limit":             {nodes.Constant},
+		"type T":                  {nodes.Record},
+		"field T.count":           {nodes.Variable},
+		"type Doer":               {nodes.Interface},
+		"method Doer.Do":          {nodes.Function},
+		"type Name":               {nodes.Record},
+		"method (*test/pkg.T).Do": {nodes.Function},
+		"func f":                  {nodes.Function},
+		"param f:n":               {nodes.Variable},
+	}
+	for sig, kinds := range want {
+		if err := testutil.DeepEqual(kinds, got[sig]); err != nil {
+			t.Errorf("OnNode calls for %q: %v", sig, err)
+		}
+	}
+
+	// Every binding reports its target exactly once.
+	for _, e := range entries {
+		if isEdge(e) && e.EdgeKind == edges.DefinesBinding && e.Target.Signature != "package" {
+			if n := len(got[e.Target.Signature]); n != 1 {
+				t.Errorf("OnNode calls for %q: got %d, want 1", e.Target.Signature, n)
+			}
+		}
+	}
+}
+
+func TestStableAnchors(t *testing.T) {
+	const before = `package pkg
+
+var x = 1
+
+func f() int { return x + x }
+`
+	const after = `package pkg
+
+// g is new, and shifts the offsets of everything below it.
+func g() {}
+
+var x = 1
+
+func f() int { return x + x }
+`
+	// anchors returns the signatures of the anchors with edges to each of the
+	// given targets, keyed by edge kind and target.
+	anchors := func(src string, opts *EmitOptions) map[string][]string {
+		m := make(map[string][]string)
+		for _, e := range emitSource(t, src, opts) {
+			if isEdge(e) && (e.Target.Signature == "var x" || e.Target.Signature == "func f") {
+				key := e.EdgeKind + " " + e.Target.Signature
+				m[key] = append(m[key], e.Source.Signature)
+			}
+		}
+		for _, sigs := range m {
+			sort.Strings(sigs)
+		}
+		return m
+	}
+
+	opts := &EmitOptions{AnchorScheme: StableAnchors}
+	stable := anchors(before, opts)
+	if err := testutil.DeepEqual(stable, anchors(after, opts)); err != nil {
+		t.Errorf("Stable anchors changed: %v", err)
+	}
+	if refs := stable[edges.Ref+" var x"]; len(refs) != 2 || refs[0] == refs[1] {
+		t.Errorf("Stable anchors of the references to x: got %q, want 2 distinct anchors", refs)
+	}
+	for key, sigs := range stable {
+		for _, sig := range sigs {
+			if !strings.HasPrefix(sig, "@") {
+				t.Errorf("Stable anchor for %s: got signature %q, want a digest", key, sig)
+			}
+		}
+	}
+
+	if err := testutil.DeepEqual(anchors(before, nil), anchors(after, nil)); err == nil {
+		t.Error("Offset anchors did not change when the offsets did")
+	}
+
+	// A span within a longer word is not an occurrence of its text, and must
+	// not share the vname of the next occurrence that is.
+	const words = "package pkg\n\nvar xx, x = 1, 2\n"
+	unit, digest := oneFileCompilation("testfile/source.go", "pkg", words)
+	pi, err := Resolve(unit, memFetcher{digest: words}, &ResolveOptions{Info: XRefTypeInfo()})
+	if err != nil {
+		t.Fatalf("Resolve failed: %v", err)
+	}
+	e := pi.newEmitter(context.Background(), func(context.Context, *spb.Entry) error { return nil }, opts)
+	file := pi.Files[0]
+	inner := strings.Index(words, "xx") + 1
+	whole := strings.Index(words, " x ") + 1
+	innerVName := e.stableAnchorVName(file, inner, inner+1)
+	wholeVName := e.stableAnchorVName(file, whole, whole+1)
+	if proto.Equal(innerVName, wholeVName) {
+		t.Errorf("Stable anchors of x within xx and of x alone are both %+v", wholeVName)
+	}
+	if !strings.HasPrefix(wholeVName.Signature, "@") {
+		t.Errorf("Stable anchor of x alone: got signature %q, want a digest", wholeVName.Signature)
+	}
+}
+
+func TestResultAssignments(t *testing.T) {
+	const input = `package pkg
+
+var count int
+
+func f() (n int) { return count }
+
+func g() (s string, _ int, err error) { return "x", 1, nil }
+
+func h() (int, error) { return count, nil }
+
+func k() (n int, err error) { return h() }
+`
+	entries := emitSource(t, input, &EmitOptions{EmitResultAssignments: true})
+
+	// Map each anchor with a result-assignment edge to its starting offset,
+	// and record the result it is assigned to.
+	got := make(map[string]string)
+	for _, e := range entries {
+		if !isEdge(e) || e.EdgeKind != edgeAssignsResult {
+			continue
+		}
+		start, _ := findFact(entries, e.Source.Signature, facts.AnchorStart)
+		got[start] = e.Target.Signature
+	}
+	offset := func(s string) string { return strconv.Itoa(strings.Index(input, s)) }
+	want := map[string]string{
+		offset("count }"): "param f:n",
+		offset(`"x"`):     "param g:s",
+		offset("nil }"):   "param g:err",
+	}
+	if err := testutil.DeepEqual(want, got); err != nil {
+		t.Errorf("Result assignments: %v", err)
+	}
+
+	// The returned variable is also referenced from the same anchor.
+	for _, e := range entries {
+		if isEdge(e) && e.EdgeKind == edgeAssignsResult && e.Target.Signature == "param f:n" {
+			if err := testutil.DeepEqual([]string{"var count"}, findEdges(entries, e.Source.Signature, edges.Ref)); err != nil {
+				t.Errorf("Refs from the returned expression: %v", err)
+			}
+		}
+	}
+
+	for _, e := range emitSource(t, input, nil) {
+		if isEdge(e) && e.EdgeKind == edgeAssignsResult {
+			t.Errorf("Result assignment edge without the option: %+v", e)
+		}
+	}
+}
+
+func TestIndexAccesses(t *testing.T) {
+	const input = `package pkg
+
+type T struct{ elts []int }
+
+func f(m map[string]int, k string, t *T, s string) {
+	m[k] = 1
+	x := m[k]
+	t.elts[x]++
+	for t.elts[0] = range t.elts {
+	}
+	_ = s[0]
+	_ = t.elts[len(t.elts)-1]
+}
+`
+	entries := emitSource(t, input, &EmitOptions{EmitIndexAccesses: true})
+
+	// Describe each access by its text and edge kind.
+	var got []string
+	for _, e := range entries {
+		if !isEdge(e) || (e.EdgeKind != edgeReads && e.EdgeKind != edgeWrites) {
+			continue
+		}
+		start, _ := findFact(entries, e.Source.Signature, facts.AnchorStart)
+		end, _ := findFact(entries, e.Source.Signature, facts.AnchorEnd)
+		i, _ := strconv.Atoi(start)
+		j, _ := strconv.Atoi(end)
+		got = append(got, fmt.Sprintf("%s %s %s", input[i:j], strings.TrimPrefix(e.EdgeKind, "/kythe/edge/go/ref/"), e.Target.Signature))
+	}
+	sort.Strings(got)
+	want := []string{
+		"m[k] reads param f:m",
+		"m[k] writes param f:m",
+		"t.elts[0] writes field T.elts",
+		"t.elts[len(t.elts)-1] reads field T.elts",
+		"t.elts[x] writes field T.elts",
+	}
+	if err := testutil.DeepEqual(want, got); err != nil {
+		t.Errorf("Index accesses: %v", err)
+	}
+
+	for _, e := range emitSource(t, input, nil) {
+		if isEdge(e) && (e.EdgeKind == edgeReads || e.EdgeKind == edgeWrites) {
+			t.Errorf("Index access edge without the option: %+v", e)
+		}
+	}
+}
+
+func TestInitOrder(t *testing.T) {
+	const input = `package pkg
+
+var (
+	a    = b + c
+	b    = f()
+	c    = 2
+	d, _ = 3, 4
+)
+
+func f() int { return d }
+
+func init() {}
+func init() {}
+`
+	want := []string{"var c", "var d", "var b", "var a", "func init#1", "func init#2"}
+
+	var got []string
+	for _, e := range emitSource(t, input, &EmitOptions{EmitInitOrder: true}) {
+		if !isEdge(e) || !strings.HasSuffix(e.Source.Signature, ".<init>") {
+			continue
+		}
+		kind, ord, ok := edges.ParseOrdinal(e.EdgeKind)
+		if !ok || kind != edgeInitOrder {
+			continue
+		}
+		for len(got) <= ord {
+			got = append(got, "")
+		}
+		got[ord] = e.Target.Signature
+	}
+	if err := testutil.DeepEqual(want, got); err != nil {
+		t.Errorf("Initialization order: %v", err)
+	}
+}
+
+func TestAPIOnly(t *testing.T) {
+	const input = `package pkg
+
+type T struct{ N int }
+
+func F(x int) int {
+	y := x + 1
+	g := func(z int) int { return z }
+	return g(y)
+}
+
+var V = F(2)
+`
+	bindings := func(opts *EmitOptions) []string {
+		var targets []string
+		for _, e := range emitSource(t, input, opts) {
+			if isEdge(e) && e.EdgeKind == edges.DefinesBinding {
+				targets = append(targets, e.Target.Signature)
+			}
+		}
+		sort.Strings(targets)
+		return targets
+	}
+
+	want := []string{"field T.N", "func F", "package", "param F:x", "type T", "var V"}
+	if err := testutil.DeepEqual(want, bindings(&EmitOptions{APIOnly: true})); err != nil {
+		t.Errorf("Bindings with APIOnly: %v", err)
+	}
+	if all := bindings(nil); len(all) != len(want)+3 {
+		t.Errorf("Bindings without APIOnly: got %+q, want %d", all, len(want)+3)
+	}
+}
+
+func TestSkipGeneratedFiles(t *testing.T) {
+	const input = `// Code generated by hand. DO NOT EDIT.
+
+package pkg
+
+func F() int { return 0 }
+`
+	countBindings := func(entries []*spb.Entry) (n int) {
+		for _, e := range entries {
+			if isEdge(e) && e.EdgeKind == edges.DefinesBinding {
+				n++
+			}
+		}
+		return n
+	}
+
+	entries := emitSource(t, input, &EmitOptions{SkipGeneratedFiles: true})
+	if n := countBindings(entries); n != 0 {
+		t.Errorf("Bindings in a generated file: got %d, want 0", n)
+	}
+	if text, ok := findFact(entries, "", facts.Text); !ok || text != input {
+		t.Errorf("Text of a generated file: got %q, %v; want %q", text, ok, input)
+	}
+	if kind, ok := findFact(entries, "func F", facts.NodeKind); !ok || kind != nodes.Function {
+		t.Errorf("Kind of a function in a generated file: got %q, %v; want %q", kind, ok, nodes.Function)
+	}
+	// Every edge leads from a node that was emitted, so none is left dangling
+	// from a hidden anchor.
+	kinds := make(map[string]string)
+	for _, e := range entries {
+		if !isEdge(e) && e.FactName == facts.NodeKind {
+			kinds[e.Source.String()] = string(e.FactValue)
+		}
+	}
+	for _, e := range entries {
+		if kind, ok := kinds[e.Source.String()]; kind == nodes.Anchor {
+			t.Errorf("Anchor in a generated file: %+v", e.Source)
+		} else if isEdge(e) && !ok {
+			t.Errorf("Edge from a node that was not emitted: %+v", e)
+		}
+	}
+	if n := countBindings(emitSource(t, input, nil)); n == 0 {
+		t.Error("Bindings without SkipGeneratedFiles: got none, wanted some")
+	}
+}
+
+func TestDocFormat(t *testing.T) {
+	const input = `package pkg
+
+// Sum adds [a] and [b].
+//
+// For example:
+//
+//	Sum(1, 2) // == 3
+//	 Sum(len("\n"), 2)
+//
+// Done.
+func Sum(a, b int) int { return a + b }
+`
+	tests := []struct {
+		format DocFormat
+		want   string
+	}{
+		{KytheEscaped, "Sum adds \\[a\\] and \\[b\\].\n\nFor example:\n\n\tSum(1, 2) // == 3\n\t Sum(len(\"\\\\n\"), 2)\n\nDone."},
+		{Raw, "Sum adds [a] and [b].\n\nFor example:\n\n\tSum(1, 2) // == 3\n\t Sum(len(\"\\n\"), 2)\n\nDone."},
+		{Markdown, "Sum adds [a] and [b].\n\nFor example:\n\n```\nSum(1, 2) // == 3\n Sum(len(\"\\n\"), 2)\n```\n\nDone."},
+	}
+	for _, test := range tests {
+		entries := emitSource(t, input, &EmitOptions{DocFormat: test.format})
+		if got, ok := findFact(entries, "func Sum doc", facts.Text); !ok {
+			t.Errorf("Doc format %v: no doc text found", test.format)
+		} else if got != test.want {
+			t.Errorf("Doc format %v: got %q, want %q", test.format, got, test.want)
+		}
+	}
+}
+
+func TestDocNodeTransform(t *testing.T) {
+	const input = `package pkg
+
+// Sum adds [a] and [b].
+func Sum(a, b int) int { return a + b }
+
+// Zero is nothing.
+var Zero int
+`
+	var targets []string
+	entries := emitSource(t, input, &EmitOptions{
+		DocNodeTransform: func(target *spb.VName, text string) string {
+			targets = append(targets, target.Signature)
+			return strings.ToUpper(text)
+		},
+	})
+	tests := []struct{ signature, want string }{
+		{"func Sum doc", "SUM ADDS \\[A\\] AND \\[B\\]."}, // the result is still escaped
+		{"var Zero doc", "ZERO IS NOTHING."},
+	}
+	for _, test := range tests {
+		if got, ok := findFact(entries, test.signature, facts.Text); !ok {
+			t.Errorf("Transformed doc %q: no doc text found", test.signature)
+		} else if got != test.want {
+			t.Errorf("Transformed doc %q: got %q, want %q", test.signature, got, test.want)
+		}
+	}
+	sort.Strings(targets)
+	if err := testutil.DeepEqual([]string{"func Sum", "var Zero"}, targets); err != nil {
+		t.Errorf("Transformed doc targets: %v", err)
+	}
+
+	// Without a transform, the text is unchanged.
+	if got, _ := findFact(emitSource(t, input, nil), "var Zero doc", facts.Text); got != "Zero is nothing." {
+		t.Errorf("Untransformed doc: got %q, want %q", got, "Zero is nothing.")
+	}
+}
+
+func TestSkipDocNodes(t *testing.T) {
+	const input = `// Package pkg is documented.
+package pkg
+
+// Sum adds a and b.
+func Sum(a, b int) int { return a + b }
+`
+	docBase := &url.URL{Scheme: "https", Host: "godoc.org"}
+	countDocs := func(entries []*spb.Entry) (n int) {
+		for _, e := range entries {
+			if e.FactName == facts.NodeKind && string(e.FactValue) == nodes.Doc {
+				n++
+			} else if isEdge(e) && e.EdgeKind == edges.Documents {
+				n++
+			}
+		}
+		return n
+	}
+
+	entries := emitSource(t, input, &EmitOptions{DocBase: docBase, SkipDocNodes: true})
+	if n := countDocs(entries); n != 0 {
+		t.Errorf("Doc nodes and edges with SkipDocNodes: got %d, want 0", n)
+	}
+	if got, ok := findFact(entries, "package", facts.DocURI); !ok || got != "https://godoc.org/test/pkg" {
+		t.Errorf("Doc URI with SkipDocNodes: got %q, %v; want %q", got, ok, "https://godoc.org/test/pkg")
+	}
+	if n := countDocs(emitSource(t, input, &EmitOptions{DocBase: docBase})); n == 0 {
+		t.Error("Doc nodes and edges without SkipDocNodes: got none, wanted some")
+	}
+}
+
+func TestTodos(t *testing.T) {
+	const input = `package pkg
+
+// F does things.
+// TODO(alice): do more things. FIXME: and faster.
+func F() {
+	// BUG(bob): it does nothing
+}
+
+// Not a BUGGY marker, nor TODOs.
+var V int
+`
+	entries := emitSource(t, input, &EmitOptions{EmitTodos: true})
+
+	var got []string
+	for _, diag := range findEdges(entries, "func F", edges.Tagged) {
+		msg, _ := findFact(entries, diag, facts.Message)
+		got = append(got, msg)
+	}
+	sort.Strings(got)
+	want := []string{"BUG(bob): it does nothing", "FIXME: and faster.", "TODO(alice): do more things."}
+	if err := testutil.DeepEqual(want, got); err != nil {
+		t.Errorf("Markers tagged by F: %v", err)
+	}
+	if got := findEdges(entries, "var V", edges.Tagged); len(got) != 0 {
+		t.Errorf("Markers tagged by V: got %+q, want none", got)
+	}
+}
+
+func TestEmitStream(t *testing.T) {
+	const input = `package pkg
+
+// T is a type.
+type T struct{ N int }
+
+func (T) Get() int { return new(T).N }
+`
+	unit, digest := oneFileCompilation("testfile/source.go", "pkg", input)
+	resolve := func() *PackageInfo {
+		pi, err := Resolve(unit, memFetcher{digest: input}, &ResolveOptions{Info: XRefTypeInfo()})
+		if err != nil {
+			t.Fatalf("Resolve failed: %v", err)
+		}
+		return pi
+	}
+
+	var got []*spb.Entry
+	entries, errc := resolve().EmitStream(context.Background(), nil)
+	for entry := range entries {
+		got = append(got, entry)
+	}
+	if err := <-errc; err != nil {
+		t.Errorf("EmitStream: unexpected error: %v", err)
+	}
+	if err := testutil.DeepEqual(emitSource(t, input, nil), got); err != nil {
+		t.Errorf("EmitStream: entries differ from Emit: %v", err)
+	}
+
+	// Cancelling the context stops the stream early.
+	ctx, cancel := context.WithCancel(context.Background())
+	entries, errc = resolve().EmitStream(ctx, nil)
+	<-entries
+	cancel()
+	var n int
+	for range entries {
+		n++
+	}
+	if err := <-errc; err != context.Canceled {
+		t.Errorf("EmitStream after cancellation: got error %v, want %v", err, context.Canceled)
+	}
+	if n >= len(got)-1 {
+		t.Errorf("EmitStream after cancellation: got %d more entries, want fewer than %d", n, len(got)-1)
+	}
+}
+
 // isEdge reports whether e represents an edge.
 func isEdge(e *spb.Entry) bool { return e.Target != nil && e.EdgeKind != "" }
@@ -50,3 +50,16 @@ var g = func(elt struct {
 	//- @elt ref Elt
 	return len(elt.P)
 }
+
+//- @w defines/binding W
+//- W.node/kind variable
+func h(w interface {
+	//- @Write defines/binding Write
+	//- Write.node/kind function
+	//- !{Write childof _}
+	Write([]byte) (int, error)
+}) {
+	//- @Write ref Write
+	//- @w ref W
+	w.Write(nil)
+}
@@ -0,0 +1,28 @@
+// Package arr tests references to constants used as array lengths.
+package arr
+
+//- @N defines/binding N
+const N = 4
+
+const (
+	//- @Size defines/binding Size
+	Size = iota + 2
+)
+
+//- @N ref N
+var x [N]int
+
+type S struct {
+	//- @Size ref Size
+	buf [Size]byte
+
+	//- @N ref N
+	//- @Size ref Size
+	grid [N * Size]int
+}
+
+func local() {
+	//- @N ref N
+	var y [N]bool
+	_ = y
+}
@@ -0,0 +1,37 @@
+// Package cref tests references to constants from other packages in
+// constant declarations, both alone and in groups.
+package cref
+
+import (
+	//- @"\"math\"" ref/imports Math=vname("package","golang.org","","math",_)
+	"math"
+)
+
+//- @Max defines/binding Max
+//- Max.node/kind constant
+//- @math ref Math
+//- @MaxInt32 ref MaxInt32=vname("const MaxInt32","golang.org","","math","go")
+const Max = math.MaxInt32
+
+const (
+	//- @First defines/binding First
+	//- First.node/kind constant
+	First = iota
+
+	//- @Second defines/binding Second
+	//- Second.node/kind constant
+	Second
+
+	//- @Limit defines/binding Limit
+	//- Limit.node/kind constant
+	//- @math ref Math
+	//- @MaxInt8 ref MaxInt8=vname("const MaxInt8","golang.org","","math","go")
+	Limit = math.MaxInt8 + iota
+
+	//- @Smallest defines/binding Smallest
+	//- Smallest.node/kind constant
+	//- @math ref Math
+	//- @SmallestNonzeroFloat64 ref Smallest64
+	//-   = vname("const SmallestNonzeroFloat64","golang.org","","math","go")
+	Smallest = math.SmallestNonzeroFloat64
+)
@@ -0,0 +1,26 @@
+// Package doclinks tests references from the doc links in comments.
+package doclinks
+
+//- @"\"io\"" ref/imports IO=vname("package","golang.org","","io",_)
+import "io"
+
+//- @Buffer defines/binding Buffer
+//- @Drain defines/binding Drain
+type Buffer struct{ data []byte }
+
+func (b *Buffer) Drain() {}
+
+//- @io ref IO
+//- @Reader ref Reader=vname("type Reader","golang.org","","io","go")
+//- @#1io ref IO
+//- @#1Reader ref Reader
+//- @#2Read ref vname("method (io.Reader).Read","golang.org","","io","go")
+//- @Buffer ref Buffer
+//- @#1Buffer ref Buffer
+//- @Drain ref Drain
+//- !{@Unknown ref _}
+
+// Fill copies from an [io.Reader] into a [Buffer].  See [io.Reader.Read] and
+// [Buffer.Drain], but not [Unknown].
+//- @Fill defines/binding Fill
+func Fill(b *Buffer, r io.Reader) {}
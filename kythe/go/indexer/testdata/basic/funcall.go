@@ -5,6 +5,9 @@ package fun
 //- @"\"os/exec\"" ref/imports OSExec
 import "os/exec"
 
+//- @"\"time\"" ref/imports Time
+import "time"
+
 //- Pkg.node/kind package
 //- Init childof Pkg
 //- Init.node/kind function
@@ -17,6 +20,9 @@ type T struct{}
 //- @M defines/binding Meth = vname("method (*test/fun.T).M", "test", _, "fun", "go")
 func (p *T) M() {}
 
+//- @V defines/binding Value = vname("method (test/fun.T).V", "test", _, "fun", "go")
+func (T) V() {}
+
 //- @F ref Fun
 //- TCall=@"F()" ref/call Fun
 //- TCall childof Init
@@ -37,6 +43,44 @@ func init() {
 	t.M()
 }
 
+// A method resolves to its declaration whether its receiver is a pointer or an
+// addressable value whose address is taken implicitly.
+//
+//- @p defines/binding P
+//- @ts defines/binding TS
+//- @m defines/binding Map
+func receivers(p *T, ts []T, m map[string]*T) {
+	//- @p ref P
+	//- @M ref Meth
+	//- @"p.M()" ref/call Meth
+	p.M()
+
+	//- @p ref P
+	//- @V ref Value
+	//- @"p.V()" ref/call Value
+	p.V()
+
+	//- @ts ref TS
+	//- @M ref Meth
+	//- @"ts[0].M()" ref/call Meth
+	ts[0].M()
+
+	//- @holder defines/binding Holder
+	//- @inner defines/binding Inner
+	var holder struct{ inner T }
+
+	//- @holder ref Holder
+	//- @inner ref Inner
+	//- @M ref Meth
+	//- @"holder.inner.M()" ref/call Meth
+	holder.inner.M()
+
+	//- @m ref Map
+	//- @M ref Meth
+	//- @"m[\"k\"].M()" ref/call Meth
+	m["k"].M()
+}
+
 func imported() {
 	//- @cmd defines/binding Cmd
 	//- @exec ref OSExec
@@ -48,3 +92,126 @@ func imported() {
 	//- @"cmd.Run()" ref/call CmdRun
 	cmd.Run()
 }
+
+//- @MyInt defines/binding MyInt
+type MyInt int
+
+// Type conversions are not calls.
+func conversions(s string, x int) {
+	//- @MyInt ref MyInt
+	//- !{@"MyInt(x)" ref/call _}
+	_ = MyInt(x)
+
+	//- @byte ref Byte
+	//- !{@"[]byte(s)" ref/call _}
+	_ = []byte(s)
+
+	//- @byte ref Byte
+	//- !{@"byte(x)" ref/call _}
+	_ = byte(x)
+}
+
+// Conversions to types from other packages are not calls either.
+//
+//- @count defines/binding Count
+func importedConversions(count int64) {
+	//- @time ref Time
+	//- @Duration ref Duration
+	//-   = vname("type Duration","golang.org","","time","go")
+	//- @count ref Count
+	//- !{@"time.Duration(count)" ref/call _}
+	//- !{@Duration ref/call _}
+	_ = time.Duration(count)
+}
+
+//- @getItems defines/binding GetItems
+func getItems() []int { return nil }
+
+//- @events defines/binding Events
+func events() <-chan string { return nil }
+
+// The source of a range loop is attributed like any other expression.
+//- @ranges defines/binding Ranges
+//- @items defines/binding Items
+func ranges(items []int) {
+	//- @x defines/binding X
+	//- @getItems ref GetItems
+	//- ItemsCall=@"getItems()" ref/call GetItems
+	//- ItemsCall childof Ranges
+	for x := range getItems() {
+		//- @x ref X
+		_ = x
+	}
+
+	//- @items ref Items
+	for range items {
+	}
+
+	//- @events ref Events
+	//- @"events()" ref/call Events
+	for e := range events() {
+		_ = e
+	}
+}
+
+//- @apply defines/binding Apply
+func apply(n int, f func(int) int) int { return f(n) }
+
+// Calls inside a function literal passed inline as an argument are blamed on
+// the literal, while the call that receives it is blamed on its caller.
+//
+//- @inline defines/binding Inline
+func inline(n int) int {
+	//- ApplyCall=@"apply(n, func(k int) int { return k * F() })" ref/call Apply
+	//- ApplyCall childof Inline
+	//- @"func(k int) int { return k * F() }" defines Lit
+	//- Lit.node/kind function
+	//- InnerCall=@"F()" ref/call Fun
+	//- InnerCall childof Lit
+	//- !{InnerCall childof Inline}
+	return apply(n, func(k int) int { return k * F() })
+}
+
+type Namer interface {
+	//- @Name defines/binding NameMethod
+	Name() string
+}
+
+// The variables of a range loop are referred to in its body by the objects
+// they are bound to, so calls to their methods resolve like any other.
+//
+//- @names defines/binding Names
+func names(ns []Namer, ch chan Namer) {
+	//- @n defines/binding N
+	for _, n := range ns {
+		//- @n ref N
+		//- @Name ref NameMethod
+		//- NameCall=@"n.Name()" ref/call NameMethod
+		//- NameCall childof Names
+		_ = n.Name()
+	}
+
+	//- @c defines/binding C
+	for c := range ch {
+		//- @c ref C
+		//- @Name ref NameMethod
+		//- @"c.Name()" ref/call NameMethod
+		c.Name()
+	}
+}
+
+// Taking the address of a receiver explicitly does not change what a call
+// through it refers to: the operand refers to the variable, and the selector
+// to the pointer method.
+//
+//- @addressed defines/binding Addressed
+func addressed() {
+	//- @t defines/binding LocalT
+	var t T
+
+	//- @t ref LocalT
+	//- @M ref Meth
+	//- AddrCall=@"(&t).M()" ref/call Meth
+	//- AddrCall childof Addressed
+	(&t).M()
+}
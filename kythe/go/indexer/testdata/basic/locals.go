@@ -55,3 +55,63 @@ func foo() {
 	//- @bravo ref Bravo
 	_ = bravo
 }
+
+func use(int) {}
+
+// Short declarations in nested blocks shadow each other, and each use refers
+// to the innermost binding in scope.
+//
+//- @shadows defines/binding Shadows
+func shadows() {
+	//- @x defines/binding X1
+	//- X1 childof Shadows
+	x := 1
+	{
+		//- @x defines/binding X2
+		//- X2 childof Shadows
+		//- !{@x ref X1}
+		x := 2
+
+		//- @x ref X2
+		use(x)
+		{
+			//- @#0x defines/binding X3
+			//- @#1x ref X2
+			//- X3 childof Shadows
+			x := x + 1
+
+			//- @x ref X3
+			use(x)
+		}
+
+		//- @x ref X2
+		use(x)
+	}
+
+	//- @x ref X1
+	use(x)
+}
+
+//- @Foo defines/binding FooType
+type Foo struct{}
+
+func consume(Foo) {}
+
+// A comma-ok type assertion binds both the value and the boolean, and refers
+// to the asserted type.
+//
+//- @asserts defines/binding Asserts
+func asserts(i interface{}) {
+	//- @v defines/binding V
+	//- V.node/kind variable
+	//- V childof Asserts
+	//- @ok defines/binding OK
+	//- OK.node/kind variable
+	//- OK childof Asserts
+	//- @Foo ref FooType
+	//- @#1ok ref OK
+	if v, ok := i.(Foo); ok {
+		//- @v ref V
+		consume(v)
+	}
+}
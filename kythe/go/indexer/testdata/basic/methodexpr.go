@@ -0,0 +1,32 @@
+// Package mexpr tests references in method expressions.
+package mexpr
+
+import "bytes"
+
+//- @T defines/binding T
+type T struct{}
+
+//- @M defines/binding M
+func (*T) M() {}
+
+//- @V defines/binding V
+func (T) V() {}
+
+//- @T ref T
+//- @M ref M
+var m = (*T).M
+
+//- @T ref T
+//- @V ref V
+var v = (*T).V
+
+func f() {
+	//- @Buffer ref Buffer
+	//-   = vname("type Buffer","golang.org","","bytes","go")
+	//- @WriteString ref WriteString
+	//-   = vname("method (*bytes.Buffer).WriteString","golang.org","","bytes","go")
+	w := (*bytes.Buffer).WriteString
+
+	//- @Buffer ref Buffer
+	w(new(bytes.Buffer), "")
+}
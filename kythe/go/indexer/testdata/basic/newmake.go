@@ -0,0 +1,39 @@
+// Package newmake tests references to the types passed to the new and make
+// builtins.
+package newmake
+
+//- @"\"bytes\"" ref/imports Bytes=vname("package","golang.org","","bytes",_)
+import "bytes"
+
+//- @Key defines/binding Key
+type Key int
+
+//- @Value defines/binding Value
+type Value struct{}
+
+func constructors() {
+	//- @new ref New=vname("builtin-func new", "golang.org", "ref/spec", _, "go")
+	//- @bytes ref Bytes
+	//- @Buffer ref Buffer=vname("type Buffer", "golang.org", "", "bytes", "go")
+	_ = new(bytes.Buffer)
+
+	//- @make ref Make=vname("builtin-func make", "golang.org", "ref/spec", _, "go")
+	//- @Key ref Key
+	//- @Value ref Value
+	_ = make(map[Key]Value, 0)
+
+	//- @make ref Make
+	//- @bytes ref Bytes
+	//- @Buffer ref Buffer
+	_ = make([]*bytes.Buffer, 1)
+
+	//- @make ref Make
+	//- @Key ref Key
+	//- @bytes ref Bytes
+	//- @Buffer ref Buffer
+	_ = make(map[Key]bytes.Buffer)
+
+	//- @new ref New
+	//- @Value ref Value
+	_ = new(chan Value)
+}
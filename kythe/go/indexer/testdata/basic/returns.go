@@ -0,0 +1,23 @@
+// Package ret tests references from naked returns to named results.
+package ret
+
+//- @count defines/binding Count
+//- @err defines/binding Err
+func counter() (count int, err error) {
+	//- @count ref Count
+	count = 5
+
+	//- @return ref Count
+	//- @return ref Err
+	return
+}
+
+//- @n defines/binding N
+func explicit() (n int) {
+	//- !{@return ref N}
+	return 0
+}
+
+func blank() (_ int) {
+	return
+}
@@ -1,6 +1,8 @@
 // Package impl tests implementation relationships.
 package impl
 
+import "io"
+
 //- @Busy defines/binding BusyInterface
 type Busy interface {
 	//- @Do defines/binding DoMethod
@@ -26,3 +28,35 @@ type Bad1 bool
 //- @Bad2 defines/binding BeOnly
 //- !{ BeOnly satisfies Busy}
 type Bad2 float64
+
+// A struct satisfies an interface it embeds, through the promoted methods of
+// the embedded field, as does a struct embedding a pointer to that struct.
+
+//- @Embedder defines/binding Embedder
+//- Embedder satisfies Busy
+type Embedder struct{ Busy }
+
+//- @PtrEmbedder defines/binding PtrEmbedder
+//- PtrEmbedder satisfies Busy
+type PtrEmbedder struct{ *Embedder }
+
+// The promoted methods are those of the interface, so they do not override it.
+//- !{ DoMethod overrides DoMethod }
+//- !{ BeMethod overrides BeMethod }
+
+// A struct embedding an interface from another package satisfies it, and calls
+// to the promoted methods refer to the methods of the interface.
+
+//- @LimitedReader defines/binding LimitedReader
+//- LimitedReader satisfies IOReader
+type LimitedReader struct {
+	//- @Reader ref IOReader
+	io.Reader
+	N int
+}
+
+func readSome(r LimitedReader, buf []byte) {
+	//- @Read ref ReadMethod
+	//- @"r.Read(buf)" ref/call ReadMethod
+	r.Read(buf)
+}
@@ -45,3 +45,62 @@ func init() {
 	//- !{RunRef childof _}
 	cmd.Run()
 }
+
+// Verify that each hop of a selector through embedded fields refers to the
+// field it selects, whether the embedding path is explicit or implicit.
+
+//- @Leaf defines/binding Leaf
+type Leaf struct {
+	//- @Field defines/binding Field
+	Field int
+}
+
+//- @Inner defines/binding Inner
+type Inner struct {
+	//- @Leaf defines/binding InnerLeaf
+	//- @Leaf ref Leaf
+	//- InnerLeaf childof Inner
+	Leaf
+}
+
+//- @Outer defines/binding Outer
+type Outer struct {
+	//- @Inner defines/binding OuterInner
+	//- @Inner ref Inner
+	//- OuterInner childof Outer
+	Inner
+}
+
+func hops(t Outer) {
+	//- @Inner ref OuterInner
+	//- @Leaf ref InnerLeaf
+	//- @Field ref Field
+	_ = t.Inner.Leaf.Field
+
+	//- @Inner ref OuterInner
+	//- @Field ref Field
+	_ = t.Inner.Field
+
+	//- @Field ref Field
+	_ = t.Field
+}
+
+// Verify that selectors through the receiver of a method on an embedding type
+// refer to the declarations of the promoted fields and methods.
+
+//- @Touch defines/binding Touch
+func (Leaf) Touch() {}
+
+//- @poke defines/binding Poke
+//- @o defines/binding Recv
+func (o *Outer) poke() int {
+	//- @o ref Recv
+	//- @Touch ref Touch
+	//- TouchCall=@"o.Touch()" ref/call Touch
+	//- TouchCall childof Poke
+	o.Touch()
+
+	//- @o ref Recv
+	//- @Field ref Field
+	return o.Field
+}
@@ -1,12 +1,16 @@
 // Package tspec tests properties of type declarations.
 package tspec
 
+//- @"\"fmt\"" ref/imports FmtPkg=vname("package", "golang.org", _, "fmt", "go")
 import "fmt"
 
 //- @Int defines/binding Int
 //- @"Int int" defines Int
 //- Int.node/kind record
 //- Int.subkind type
+//- @int ref IntType
+//-   = vname("builtin-type int", "golang.org", "ref/spec", _, "go")
+//- Int go/definedfrom IntType
 type Int int
 
 //- @Ptr defines/binding Ptr
@@ -32,6 +36,7 @@ type UPtr *under
 //- Struct.subkind struct
 type Struct struct {
 	//- @Alpha defines/binding Alpha
+	//- @"Alpha string" defines Alpha
 	//- Alpha.node/kind variable
 	//- Alpha.subkind field
 	//- Alpha childof Struct
@@ -59,6 +64,7 @@ type Embed struct {
 	// An embedded pointer type.
 	//
 	//- @"float64" defines/binding EmbedFloat
+	//- @"*float64" defines EmbedFloat
 	//- EmbedFloat.node/kind variable
 	//- EmbedFloat.subkind field
 	*float64
@@ -68,6 +74,8 @@ type Embed struct {
 	//- @"Stringer" defines/binding FmtStringer
 	//- FmtStringer.node/kind variable
 	//- FmtStringer.subkind field
+	//- @"Stringer" ref FmtStringerType
+	//-   = vname("type Stringer","golang.org","","fmt","go")
 	fmt.Stringer
 
 	// A regular field mixed with the above.
@@ -78,6 +86,15 @@ type Embed struct {
 	Velocipede struct{}
 }
 
+// A field embedded from another package is selected by the base name of its
+// type.
+//
+//- @Stringer ref FmtStringerType
+func useEmbed(e Embed) fmt.Stringer {
+	//- @Stringer ref FmtStringer
+	return e.Stringer
+}
+
 //- @Thinger defines/binding Thinger
 //- Thinger.node/kind interface
 type Thinger interface {
@@ -98,3 +115,78 @@ type Extender interface {
 	//- Extend childof Extender
 	Extend()
 }
+
+// An interface may embed an interface from another package.
+//
+//- @Qualified defines/binding Qualified
+//- Qualified.node/kind interface
+//- Qualified extends FmtStringerType
+type Qualified interface {
+	//- @fmt ref FmtPkg
+	//- @Stringer ref FmtStringerType
+	fmt.Stringer
+}
+
+// Named types from another package are referenced from field types, including
+// when they appear within composite types.
+//
+//- @Fields defines/binding Fields
+//- Fields.node/kind record
+type Fields struct {
+	//- @fmt ref FmtPkg
+	//- @Stringer ref FmtStringerType
+	Plain fmt.Stringer
+
+	//- @fmt ref FmtPkg
+	//- @Stringer ref FmtStringerType
+	Pointer *fmt.Stringer
+
+	//- @fmt ref FmtPkg
+	//- @Stringer ref FmtStringerType
+	Slice []fmt.Stringer
+
+	//- @fmt ref FmtPkg
+	//- @Stringer ref FmtStringerType
+	Map map[string]fmt.Stringer
+
+	//- @Formatter ref FmtFormatterType
+	//-   = vname("type Formatter","golang.org","","fmt","go")
+	//- @Stringer ref FmtStringerType
+	Func func(fmt.Formatter) fmt.Stringer
+
+	//- @Formatter ref FmtFormatterType
+	Chan chan<- fmt.Formatter
+}
+
+// The parameters of a function-typed field are bound, but have no parent.
+//
+//- @Callbacks defines/binding Callbacks
+//- Callbacks.node/kind record
+type Callbacks struct {
+	//- @OnEvent defines/binding OnEvent
+	//- OnEvent childof Callbacks
+	//- @name defines/binding Name
+	//-   = vname("param Callbacks.OnEvent:name", "test", _, "typespec", "go")
+	//- Name.node/kind variable
+	//- !{Name childof _}
+	//- @ok defines/binding OK
+	//- OK.node/kind variable
+	OnEvent func(name string) (ok bool)
+}
+
+// A type defined from a named type is linked to it, even if that type is
+// declared in another package.
+//
+//- @Named defines/binding Named
+//- Named go/definedfrom Int
+type Named Int
+
+//- @Printer defines/binding Printer
+//- @Stringer ref FmtStringerType
+//- Printer go/definedfrom FmtStringerType
+//- !{Printer go/definedfrom FmtPkg}
+type Printer fmt.Stringer
+
+// Types defined by a type literal are not.
+//- !{Struct go/definedfrom _}
+//- !{Ptr go/definedfrom _}
@@ -5,6 +5,7 @@ package def
 //- Pkg.node/kind package
 
 //- @topLevel defines/binding TopLevel
+//- @"topLevel int" defines TopLevel
 //- TopLevel.node/kind variable
 //- TopLevel childof Pkg
 var topLevel int
@@ -12,6 +13,7 @@ var topLevel int
 //- @outer defines/binding Outer
 func outer() {
 	//- @stabby defines/binding V
+	//- @"stabby bool" defines V
 	//- V.node/kind variable
 	//- V childof Outer
 	var stabby bool
@@ -20,6 +22,7 @@ func outer() {
 }
 
 //- @magic defines/binding Const
+//- @"magic = \"beans\"" defines Const
 //- Const.node/kind constant
 //- Const childof Pkg
 const magic = "beans"
@@ -1,5 +1,7 @@
 package structinit
 
+import "bytes"
+
 //- @Inky defines/binding Inky
 //- Inky.node/kind record
 //- Inky.subkind struct
@@ -77,3 +79,92 @@ func realNames() {
 		{name: "pokey", nick: "clyde"},
 	}
 }
+
+func nested() {
+	// Verify that struct literals nested in slice and map literals ref/init
+	// their fields, including keyed fields given out of order.
+
+	//- @Inky ref Inky
+	_ = []Inky{
+		//- @Sue ref Sue
+		//- @"1" ref/init Sue
+		{Sue: 1},
+	}
+
+	//- @Inky ref Inky
+	_ = map[string]*Inky{
+		//- @Blinky ref Blinky
+		//- @"nil" ref/init Blinky
+		//- @Pinky ref Pinky
+		//- @"\"blue\"" ref/init Pinky
+		"inky": {Blinky: nil, Pinky: "blue"},
+	}
+
+	//- @key defines/binding Key
+	type key struct {
+		//- @id defines/binding ID
+		id int
+	}
+
+	//- @key ref Key
+	_ = map[key]bool{
+		//- @id ref ID
+		//- @"2" ref/init ID
+		{id: 2}: true,
+	}
+}
+
+func literalTypes() {
+	// Verify that the explicit type of a composite literal refs the named
+	// types it mentions, including element, key, and qualified types.
+
+	//- @Inky ref Inky
+	_ = Inky{Sue: 3}
+
+	//- @Inky ref Inky
+	_ = map[string]Inky{}
+
+	//- @Inky ref Inky
+	_ = [2]Inky{{Sue: 4}}
+
+	//- @#0Inky ref Inky
+	//- @#1Inky ref Inky
+	_ = map[*Inky][]Inky{}
+
+	//- @bytes ref BytesPkg
+	//-   = vname("package","golang.org","","bytes","go")
+	//- @Buffer ref Buffer
+	//-   = vname("type Buffer","golang.org","","bytes","go")
+	_ = bytes.Buffer{}
+
+	//- @bytes ref BytesPkg
+	//- @Buffer ref Buffer
+	_ = []*bytes.Buffer{{}}
+}
+
+func embedded() {
+	// Verify that keys naming embedded fields ref the fields, and not the
+	// types whose base names they share.
+
+	//- @Clyde defines/binding Clyde
+	type Clyde struct{ speed int }
+
+	//- @Chase defines/binding Chase
+	//- @Clyde defines/binding ClydeField
+	//- @Inky defines/binding InkyField
+	type Chase struct {
+		Clyde
+		*Inky
+	}
+
+	//- @Chase ref Chase
+	//- @Clyde ref ClydeField
+	//- !{@Clyde ref Clyde}
+	//- @#1Clyde ref Clyde
+	//- @"Clyde{speed: 5}" ref/init ClydeField
+	//- @Inky ref InkyField
+	//- !{@Inky ref Inky}
+	//- @#1Inky ref Inky
+	//- @"&Inky{}" ref/init InkyField
+	_ = Chase{Clyde: Clyde{speed: 5}, Inky: &Inky{}}
+}
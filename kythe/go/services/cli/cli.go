@@ -22,6 +22,7 @@ import (
 	"encoding/json"
 	"flag"
 	"fmt"
+	"io"
 	"log"
 	"os"
 	"strings"
@@ -39,8 +40,9 @@ import (
 var DisplayJSON bool
 
 var (
-	logRequests = flag.Bool("log_requests", false, "Log all requests to stderr as JSON")
-	out         = os.Stdout
+	logRequests           = flag.Bool("log_requests", false, "Log all requests to stderr as JSON")
+	out         io.Writer = os.Stdout
+	in          io.Reader = os.Stdin
 )
 
 var jsonMarshaler = web.JSONMarshaler
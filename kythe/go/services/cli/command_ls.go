@@ -17,22 +17,77 @@
 package cli
 
 import (
+	"bufio"
+	"bytes"
 	"context"
+	"encoding/json"
 	"errors"
 	"flag"
 	"fmt"
+	"io"
+	"log"
 	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
 
+	"kythe.io/kythe/go/platform/delimited"
 	"kythe.io/kythe/go/services/filetree"
+	"kythe.io/kythe/go/services/xrefs"
 	"kythe.io/kythe/go/util/kytheuri"
+	"kythe.io/kythe/go/util/schema/edges"
+	"kythe.io/kythe/go/util/schema/facts"
+	"kythe.io/kythe/go/util/schema/nodes"
 
 	ftpb "kythe.io/kythe/proto/filetree_proto"
+	gpb "kythe.io/kythe/proto/graph_proto"
+	spb "kythe.io/kythe/proto/storage_proto"
+	xpb "kythe.io/kythe/proto/xref_proto"
 )
 
 type lsCommand struct {
 	lsURIs    bool
+	absolute  bool
 	filesOnly bool
 	dirsOnly  bool
+	showLangs bool
+	excludes  globList
+
+	pageAfter  string
+	pageBefore string
+	pageLimit  int
+
+	recursive bool
+	traversal string
+	hideEmpty bool
+	tree      bool
+	ascii     bool
+	withDepth bool
+
+	batch bool
+
+	showSizes bool
+	human     bool
+
+	showPackage bool
+	childCounts bool
+	counts      *countCache // shared by the listings of a --batch run
+
+	onlyCount bool
+	byLang    bool
+
+	format string
+
+	check       bool
+	emitEntries bool
+
+	followImports bool
+	importDepth   int
+
+	nonEmpty bool
+
+	raw bool
 }
 
 func (lsCommand) Name() string     { return "ls" }
@@ -40,59 +95,1437 @@ func (lsCommand) Synopsis() string { return "list a directory's contents" }
 func (lsCommand) Usage() string    { return "" }
 func (c *lsCommand) SetFlags(flag *flag.FlagSet) {
 	flag.BoolVar(&c.lsURIs, "uris", false, "Display files/directories as Kythe URIs")
+	flag.BoolVar(&c.absolute, "absolute", false, "Display the full corpus-relative paths of files/directories")
 	flag.BoolVar(&c.filesOnly, "files", false, "Display only files")
 	flag.BoolVar(&c.dirsOnly, "dirs", false, "Display only directories")
+	flag.BoolVar(&c.showLangs, "lang", false, "Display the language of each file alongside its name")
+	flag.Var(&c.excludes, "exclude", "Omit entries whose basenames match this glob, and the contents of directories that do (may be repeated)")
+	flag.StringVar(&c.pageAfter, "after", "", "Display only entries whose basename sorts after this value")
+	flag.StringVar(&c.pageBefore, "before", "", "Display only entries whose basename sorts before this value")
+	flag.IntVar(&c.pageLimit, "limit", 0, "Maximum number of entries displayed (0 displays all entries)")
+	flag.BoolVar(&c.recursive, "recursive", false, "Recursively display the contents of subdirectories")
+	flag.StringVar(&c.traversal, "traversal", "dfs", "Order in which a --recursive listing is displayed (dfs or bfs)")
+	flag.BoolVar(&c.hideEmpty, "hide_empty", false, "Omit directories from a --recursive listing if no files below them are displayed")
+	flag.BoolVar(&c.tree, "tree", false, "Display a --recursive listing as an indented tree, followed by the numbers of directories and files")
+	flag.BoolVar(&c.ascii, "ascii", false, "Draw the branches of a --tree listing with ASCII rather than Unicode characters")
+	flag.BoolVar(&c.withDepth, "with_depth", false, "Prefix each entry of a --recursive listing with its depth below the listed directory, followed by a tab")
+	flag.BoolVar(&c.batch, "batch", false, "List each of the directory URIs read from stdin, one per line")
+	flag.BoolVar(&c.showSizes, "size", false, "Display the size of each file and the total size of the files listed (looks up the text of each file)")
+	flag.BoolVar(&c.human, "human", false, "Display --size values in human-readable units (K, M, G, ...)")
+	flag.BoolVar(&c.showPackage, "show_package", false, "Display a representative file (doc.go, or else the first .go file) alongside each subdirectory that contains Go files")
+	flag.BoolVar(&c.childCounts, "child_counts", false, "Display the number of entries in each subdirectory alongside its name, or ? if it cannot be read (looks up the contents of each subdirectory)")
+	flag.BoolVar(&c.onlyCount, "only_count", false, "Display only the number of entries that would be listed")
+	flag.BoolVar(&c.byLang, "by_lang", false, "Display the number of files listed in each language, rather than the files themselves")
+	flag.BoolVar(&c.check, "check", false, "Instead of displaying a directory, check that the URIs of all its entries are well-formed, failing if any is not")
+	flag.BoolVar(&c.emitEntries, "emit_entries", false, "Display a directory as a delimited stream of wire-format Kythe entries: a node kind for each file, and a childof edge from each entry to the directory")
+	flag.BoolVar(&c.followImports, "follow_imports", false, "Instead of a directory's contents, display the directories of the packages imported by its files, as resolved from the indexed graph")
+	flag.IntVar(&c.importDepth, "import_depth", 1, "Number of levels of imports displayed by --follow_imports")
+	flag.BoolVar(&c.nonEmpty, "non_empty", false, "When listing the corpus roots, omit roots whose top-level directory is empty (looks up the directory of each root)")
+	flag.BoolVar(&c.raw, "raw", false, "Display the tickets of a directory's entries exactly as the service returns them, without parsing them")
+	flag.StringVar(&c.format, "format", "", `Output format; if set to "entries-json", display a directory as a JSON object {"entries":[{"name","uri","kind"}]} sorted by name; if set to "roots-json", display the corpus roots as a JSON array [{"corpus","root"}] sorted by corpus and root; if set to "ndjson-events", display a --recursive listing as a stream of JSON objects {"event","uri"}, one per line, with enter_dir and exit_dir events around the contents of each directory and a file event for each file`)
 }
 func (c lsCommand) Run(ctx context.Context, flag *flag.FlagSet, api API) error {
+	for _, glob := range c.excludes {
+		if _, err := filepath.Match(glob, ""); err != nil {
+			return fmt.Errorf("invalid --exclude pattern %q: %v", glob, err)
+		}
+	}
+
 	if c.filesOnly && c.dirsOnly {
 		return errors.New("--files and --dirs are mutually exclusive")
+	} else if c.lsURIs && c.absolute {
+		return errors.New("--uris and --absolute are mutually exclusive")
+	} else if c.pageLimit < 0 {
+		return fmt.Errorf("invalid --limit value (must be non-negative): %d", c.pageLimit)
+	} else if c.recursive && (c.pageAfter != "" || c.pageBefore != "" || c.pageLimit > 0) {
+		return errors.New("--after, --before, and --limit cannot be used with --recursive")
+	} else if c.recursive && c.traversal != "dfs" && c.traversal != "bfs" {
+		return fmt.Errorf("unknown --traversal order %q (must be dfs or bfs)", c.traversal)
+	} else if c.hideEmpty && (!c.recursive || c.dirsOnly) {
+		return errors.New("--hide_empty requires --recursive and cannot be used with --dirs")
+	} else if c.tree && !c.recursive {
+		return errors.New("--tree requires --recursive")
+	} else if c.tree && (DisplayJSON || c.lsURIs || c.absolute || c.onlyCount || c.format != "") {
+		return errors.New("--tree cannot be used with --json, --uris, --absolute, --only_count, or --format")
+	} else if c.withDepth && (!c.recursive || c.tree || DisplayJSON || c.onlyCount || c.byLang || c.format != "") {
+		return errors.New("--with_depth requires --recursive, and cannot be used with --tree, --json, --only_count, --by_lang, or --format")
+	} else if c.ascii && !c.tree {
+		return errors.New("--ascii requires --tree")
+	} else if c.showSizes && c.recursive {
+		return errors.New("--size cannot be used with --recursive")
+	} else if c.human && !c.showSizes {
+		return errors.New("--human requires --size")
+	} else if c.batch && c.recursive && DisplayJSON {
+		return errors.New("--batch and --recursive cannot be used together with --json")
+	} else if c.onlyCount && (c.showSizes || c.batch) {
+		return errors.New("--only_count cannot be used with --size or --batch")
+	} else if c.format != "" && c.format != entriesJSON && c.format != rootsJSON && c.format != eventsNDJSON {
+		return fmt.Errorf("unknown --format %q (must be %q, %q, or %q)", c.format, entriesJSON, rootsJSON, eventsNDJSON)
+	} else if c.format == eventsNDJSON && (!c.recursive || c.hideEmpty || c.filesOnly || c.dirsOnly || DisplayJSON) {
+		return fmt.Errorf("--format %s requires --recursive, and cannot be used with --hide_empty, --files, --dirs, or --json", eventsNDJSON)
+	} else if c.format != "" && (c.showSizes || c.onlyCount || c.batch || c.showLangs) {
+		return errors.New("--format cannot be used with --size, --only_count, --batch, or --lang")
+	} else if c.byLang && (c.dirsOnly || c.showLangs || c.showSizes || c.onlyCount || c.tree || c.check || c.format != "") {
+		return errors.New("--by_lang cannot be used with --dirs, --lang, --size, --only_count, --tree, --check, or --format")
+	} else if c.showPackage && (c.recursive || c.filesOnly || DisplayJSON || c.onlyCount || c.byLang || c.check || c.format != "") {
+		return errors.New("--show_package cannot be used with --recursive, --files, --json, --only_count, --by_lang, --check, or --format")
+	} else if c.emitEntries && (c.recursive || c.batch || DisplayJSON || c.showSizes || c.onlyCount || c.byLang || c.check || c.showPackage || c.format != "") {
+		return errors.New("--emit_entries cannot be used with --recursive, --batch, --json, --size, --only_count, --by_lang, --check, --show_package, or --format")
+	} else if c.followImports && (c.recursive || c.batch || c.filesOnly || c.dirsOnly || c.showLangs || c.showSizes || c.onlyCount || c.byLang || c.check || c.emitEntries || c.showPackage || c.format != "") {
+		return errors.New("--follow_imports cannot be used with --recursive, --batch, --files, --dirs, --lang, --size, --only_count, --by_lang, --check, --emit_entries, --show_package, or --format")
+	} else if c.followImports && c.importDepth < 1 {
+		return fmt.Errorf("invalid --import_depth value (must be positive): %d", c.importDepth)
+	} else if c.childCounts && (c.recursive || c.filesOnly || DisplayJSON || c.onlyCount || c.byLang || c.check || c.emitEntries || c.followImports || c.format != "") {
+		return errors.New("--child_counts cannot be used with --recursive, --files, --json, --only_count, --by_lang, --check, --emit_entries, --follow_imports, or --format")
+	} else if c.nonEmpty && c.batch {
+		return errors.New("--non_empty cannot be used with --batch")
+	} else if c.raw && (c.lsURIs || c.absolute || c.pageAfter != "" || c.pageBefore != "" || c.pageLimit > 0 || c.recursive || DisplayJSON || c.showLangs || c.showSizes || c.showPackage || c.childCounts || c.onlyCount || c.byLang || c.check || c.emitEntries || c.followImports || c.format != "") {
+		return errors.New("--raw can only be used with --files, --dirs, --exclude, and --batch")
+	} else if c.check && (c.recursive || c.pageAfter != "" || c.pageBefore != "" || c.pageLimit > 0 || c.showSizes || c.onlyCount || c.format != "") {
+		return errors.New("--check cannot be used with --recursive, --after, --before, --limit, --size, --only_count, or --format")
 	}
 
-	if len(flag.Args()) == 0 {
+	if c.childCounts {
+		c.counts = &countCache{counts: make(map[string]int)}
+	}
+	if c.batch {
+		if len(flag.Args()) > 0 {
+			return fmt.Errorf("--batch reads directory URIs from stdin, but arguments were given: %v", flag.Args())
+		}
+		return c.runBatch(ctx, api)
+	}
+
+	switch len(flag.Args()) {
+	case 0:
+		if c.onlyCount || c.byLang || c.check || c.emitEntries || c.followImports || c.format == entriesJSON || c.format == eventsNDJSON {
+			return fmt.Errorf("--only_count, --by_lang, --check, --emit_entries, --follow_imports, and --format %s or %s require a directory argument", entriesJSON, eventsNDJSON)
+		}
 		req := &ftpb.CorpusRootsRequest{}
 		LogRequest(req)
 		cr, err := api.FileTreeService.CorpusRoots(ctx, req)
 		if err != nil {
 			return err
 		}
+		if c.nonEmpty {
+			cr = nonEmptyRoots(ctx, api, cr)
+		}
 		return c.displayCorpusRoots(cr)
-	}
-	var corpus, root, path string
-	switch len(flag.Args()) {
 	case 1:
-		uri, err := kytheuri.Parse(flag.Arg(0))
-		if err != nil {
-			return fmt.Errorf("invalid uri %q: %v", flag.Arg(0), err)
+		if c.format == rootsJSON {
+			return fmt.Errorf("--format %s lists the corpus roots and takes no arguments", rootsJSON)
+		} else if c.nonEmpty {
+			return errors.New("--non_empty applies only to the listing of corpus roots, and takes no arguments")
 		}
-		corpus = uri.Corpus
-		root = uri.Root
-		path = uri.Path
+		return c.list(ctx, api, flag.Arg(0))
 	default:
 		return fmt.Errorf("too many arguments given: %v", flag.Args())
 	}
-	path = filetree.CleanDirPath(path)
+}
+
+// list displays the contents of the directory with the given URI.
+func (c lsCommand) list(ctx context.Context, api API, dirURI string) error {
+	uri, err := kytheuri.Parse(dirURI)
+	if err != nil {
+		return fmt.Errorf("invalid uri %q: %v", dirURI, err)
+	}
+	path := filetree.CleanDirPath(uri.Path)
+	if c.followImports {
+		dirs, err := importDirs(ctx, api, &kytheuri.URI{Corpus: uri.Corpus, Root: uri.Root, Path: path}, c.importDepth)
+		if err != nil {
+			return err
+		}
+		return c.displayImportDirs(dirs)
+	}
+	if c.recursive {
+		if c.onlyCount {
+			var dirs, files int
+			walkErr := c.walkTree(ctx, api, uri.Corpus, uri.Root, path, func(e treeEntry) error {
+				if e.isDir {
+					dirs++
+				} else {
+					files++
+				}
+				return nil
+			})
+			if !partialWalk(ctx, walkErr) {
+				return walkErr
+			} else if err := c.displayCount(dirs, files); err != nil {
+				return err
+			}
+			return walkErr
+		} else if c.byLang {
+			var files []string
+			walkErr := c.walkTree(ctx, api, uri.Corpus, uri.Root, path, func(e treeEntry) error {
+				if !e.isDir {
+					files = append(files, e.ticket)
+				}
+				return nil
+			})
+			if !partialWalk(ctx, walkErr) {
+				return walkErr
+			} else if err := displayLanguages(files); err != nil {
+				return err
+			}
+			return walkErr
+		} else if c.format == entriesJSON {
+			var entries []lsEntry
+			walkErr := c.walkTree(ctx, api, uri.Corpus, uri.Root, path, func(e treeEntry) error {
+				if (c.filesOnly && e.isDir) || (c.dirsOnly && !e.isDir) {
+					return nil
+				}
+				name := e.rel
+				if c.absolute {
+					u, err := kytheuri.Parse(e.ticket)
+					if err != nil {
+						return fmt.Errorf("received invalid uri %q: %v", e.ticket, err)
+					}
+					name = u.Path
+				}
+				entries = append(entries, newLSEntry(name, e.ticket, e.isDir))
+				return nil
+			})
+			if !partialWalk(ctx, walkErr) {
+				return walkErr
+			} else if err := displayEntries(entries, ""); err != nil {
+				return err
+			}
+			return walkErr
+		} else if c.format == eventsNDJSON {
+			return c.displayEvents(ctx, api, uri.Corpus, uri.Root, path)
+		} else if c.tree {
+			return c.displayTree(ctx, api, uri.Corpus, uri.Root, path)
+		}
+		return c.walkTree(ctx, api, uri.Corpus, uri.Root, path, c.displayTreeEntry)
+	}
+	dir, next, err := c.directory(ctx, api, uri.Corpus, uri.Root, path)
+	if err != nil {
+		return err
+	}
+	if c.raw {
+		return displayRaw(dir)
+	} else if c.check {
+		return checkDirectory(dir)
+	} else if c.format == entriesJSON {
+		entries, err := c.directoryEntries(dir)
+		if err != nil {
+			return err
+		}
+		return displayEntries(entries, next)
+	}
+	if next != "" && (c.emitEntries || c.byLang || c.onlyCount) {
+		// These displays have no place for the cursor.
+		defer log.Printf("Next page cursor: --after %q", next)
+	}
+	if c.emitEntries {
+		return displayEntryStream(&spb.VName{Corpus: uri.Corpus, Root: uri.Root, Path: path}, dir)
+	} else if c.byLang {
+		return displayLanguages(dir.File)
+	} else if c.onlyCount {
+		return c.displayCount(len(dir.Subdirectory), len(dir.File))
+	}
+	var sizes map[string]int64
+	if c.showSizes {
+		if sizes, err = fileSizes(ctx, api, dir.File); err != nil {
+			return err
+		}
+	}
+	var packages map[string]string
+	if c.showPackage {
+		packages = packageFiles(ctx, api, dir.Subdirectory)
+	}
+	var counts map[string]int
+	if c.childCounts {
+		counts = c.counts.lookup(ctx, api, dir.Subdirectory)
+	}
+	return c.displayDirectory(dir, next, sizes, packages, counts)
+}
+
+// displayRaw displays the tickets of the subdirectories and then the files of
+// d, one per line, exactly as they were returned by the service.
+func displayRaw(d *ftpb.DirectoryReply) error {
+	for _, tickets := range [][]string{d.Subdirectory, d.File} {
+		for _, ticket := range tickets {
+			if _, err := fmt.Fprintln(out, ticket); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// checkDirectory reports an error naming each of the entries of d whose URI
+// is malformed, or nil if all of them are well-formed.
+func checkDirectory(d *ftpb.DirectoryReply) error {
+	var problems []string
+	for _, dir := range d.Subdirectory {
+		if _, err := kytheuri.Parse(dir); err != nil {
+			problems = append(problems, fmt.Sprintf("invalid directory uri %q: %v", dir, err))
+		}
+	}
+	for _, file := range d.File {
+		if _, err := kytheuri.Parse(file); err != nil {
+			problems = append(problems, fmt.Sprintf("invalid file ticket %q: %v", file, err))
+		}
+	}
+	if len(problems) > 0 {
+		return fmt.Errorf("%d of %d entries are malformed:\n\t%s",
+			len(problems), len(d.Subdirectory)+len(d.File), strings.Join(problems, "\n\t"))
+	}
+	return nil
+}
+
+// displayEntryStream displays the contents of d, the directory denoted by
+// parent, as a delimited stream of wire-format Kythe entries.  Each file gets
+// a node kind fact, and each file and subdirectory gets a childof edge to
+// parent.  The Kythe schema has no node kind for directories, so they get no
+// facts of their own.
+func displayEntryStream(parent *spb.VName, d *ftpb.DirectoryReply) error {
+	entries, err := flatDirectory(d)
+	if err != nil {
+		return err
+	}
+	w := delimited.NewWriter(out)
+	for _, e := range entries {
+		vname := e.uri.VName()
+		if !e.isDir {
+			if err := w.PutProto(&spb.Entry{
+				Source:    vname,
+				FactName:  facts.NodeKind,
+				FactValue: []byte(nodes.File),
+			}); err != nil {
+				return err
+			}
+		}
+		if err := w.PutProto(&spb.Entry{
+			Source:   vname,
+			EdgeKind: edges.ChildOf,
+			Target:   parent,
+			FactName: "/",
+		}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// maxLookups is the maximum number of concurrent requests made by the options
+// that look something up for each entry of a listing, such as --size.
+const maxLookups = 8
+
+// forEachLimited calls f(i) for each i in [0, n), each call in a goroutine of
+// its own, with at most maxLookups calls running at once.  It returns when all
+// the calls have returned.  The options that make a request for each entry of
+// a listing use it to bound the number of requests in flight.
+func forEachLimited(n int, f func(i int)) {
+	sem := make(chan struct{}, maxLookups)
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(i int) {
+			defer func() { <-sem; wg.Done() }()
+			f(i)
+		}(i)
+	}
+	wg.Wait()
+}
+
+// fileSizes returns the size in bytes of each of the given files, keyed by
+// ticket.  Since a DirectoryReply does not carry file sizes, this requires a
+// node lookup for the text of every file.
+func fileSizes(ctx context.Context, api API, files []string) (map[string]int64, error) {
+	sizes := make([]int64, len(files))
+	errs := make([]error, len(files))
+	forEachLimited(len(files), func(i int) {
+		file := files[i]
+		req := &gpb.NodesRequest{
+			Ticket: []string{file},
+			Filter: []string{facts.Text},
+		}
+		LogRequest(req)
+		reply, err := api.XRefService.Nodes(ctx, req)
+		if err != nil {
+			errs[i] = fmt.Errorf("looking up the text of %q: %v", file, err)
+			return
+		}
+		if node := reply.Nodes[file]; node != nil {
+			sizes[i] = int64(len(node.Facts[facts.Text]))
+		}
+	})
+
+	m := make(map[string]int64)
+	for i, file := range files {
+		if errs[i] != nil {
+			return nil, errs[i]
+		}
+		m[file] = sizes[i]
+	}
+	return m, nil
+}
+
+// importDirs returns the directories of the packages imported by the files of
+// dir, followed by those of the packages they import, and so on up to depth
+// levels of imports.  Each directory appears once, in breadth-first order and
+// sorted within each level, and dir itself is never included.  Imports are
+// resolved from the ref/imports decorations of each file, so this requires a
+// directory request and a decorations request per file for every directory.
+func importDirs(ctx context.Context, api API, dir *kytheuri.URI, depth int) ([]*kytheuri.URI, error) {
+	seen := map[string]bool{dir.String(): true}
+	var dirs []*kytheuri.URI
+	level := []*kytheuri.URI{dir}
+	for i := 0; i < depth && len(level) > 0; i++ {
+		var next []*kytheuri.URI
+		for _, d := range level {
+			imports, err := packageImports(ctx, api, d)
+			if err != nil {
+				return nil, err
+			}
+			for _, imp := range imports {
+				if key := imp.String(); !seen[key] {
+					seen[key] = true
+					next = append(next, imp)
+				}
+			}
+		}
+		sort.Slice(next, func(i, j int) bool { return next[i].String() < next[j].String() })
+		dirs = append(dirs, next...)
+		level = next
+	}
+	return dirs, nil
+}
+
+// packageImports returns the directories of the packages imported by the files
+// of dir.  The directory of a package is taken to be its corpus, root, and
+// path, which for Go packages is the import path.
+func packageImports(ctx context.Context, api API, dir *kytheuri.URI) ([]*kytheuri.URI, error) {
+	req := &ftpb.DirectoryRequest{Corpus: dir.Corpus, Root: dir.Root, Path: dir.Path}
+	LogRequest(req)
+	reply, err := api.FileTreeService.Directory(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+
+	var imports []*kytheuri.URI
+	for _, file := range reply.File {
+		req := &xpb.DecorationsRequest{
+			Location:   &xpb.Location{Ticket: file},
+			References: true,
+		}
+		LogRequest(req)
+		decor, err := api.XRefService.Decorations(ctx, req)
+		if err == xrefs.ErrDecorationsNotFound {
+			continue
+		} else if err != nil {
+			return nil, fmt.Errorf("looking up the imports of %q: %v", file, err)
+		}
+		for _, ref := range decor.Reference {
+			if ref.Kind != edges.RefImports {
+				continue
+			}
+			pkg, err := kytheuri.Parse(ref.TargetTicket)
+			if err != nil {
+				return nil, fmt.Errorf("received invalid package ticket %q: %v", ref.TargetTicket, err)
+			}
+			imports = append(imports, &kytheuri.URI{
+				Corpus: pkg.Corpus,
+				Root:   pkg.Root,
+				Path:   filetree.CleanDirPath(pkg.Path),
+			})
+		}
+	}
+	return imports, nil
+}
+
+// displayImportDirs displays the directories found by --follow_imports: as a
+// JSON array of URIs with --json, and otherwise one per line as a URI with
+// --uris or as a path qualified by its corpus and root.
+func (c lsCommand) displayImportDirs(dirs []*kytheuri.URI) error {
+	if DisplayJSON {
+		uris := []string{} // display [] rather than null
+		for _, dir := range dirs {
+			uris = append(uris, dir.String())
+		}
+		return PrintJSON(uris)
+	}
+	for _, dir := range dirs {
+		name := dir.String()
+		if !c.lsURIs {
+			name = filepath.Join(dir.Corpus, dir.Root, dir.Path) + "/"
+		}
+		if _, err := fmt.Fprintln(out, name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// probeDirectory returns the unrestricted contents of the directory with the
+// given URI, for the options that look into each subdirectory of a listing.
+func probeDirectory(ctx context.Context, api API, dirURI string) (*ftpb.DirectoryReply, error) {
+	uri, err := kytheuri.Parse(dirURI)
+	if err != nil {
+		return nil, fmt.Errorf("invalid directory uri %q: %v", dirURI, err)
+	}
+	req := &ftpb.DirectoryRequest{
+		Corpus: uri.Corpus,
+		Root:   uri.Root,
+		Path:   filetree.CleanDirPath(uri.Path),
+	}
+	LogRequest(req)
+	return api.FileTreeService.Directory(ctx, req)
+}
+
+// packageFiles returns the ticket of a representative Go file for each of the
+// given directories that contains any, keyed by directory URI.  The lookups
+// are best-effort: a directory that cannot be read is logged and left out.
+func packageFiles(ctx context.Context, api API, dirs []string) map[string]string {
+	files := make([]string, len(dirs))
+	forEachLimited(len(dirs), func(i int) {
+		reply, err := probeDirectory(ctx, api, dirs[i])
+		if err != nil {
+			log.Printf("Skipping package lookup for %q: %v", dirs[i], err)
+			return
+		}
+		files[i] = packageFile(reply.File)
+	})
+
+	m := make(map[string]string)
+	for i, dir := range dirs {
+		if files[i] != "" {
+			m[dir] = files[i]
+		}
+	}
+	return m
+}
+
+// A countCache records the number of entries in each directory looked up by
+// --child_counts, so that no directory is read more than once in a run.
+type countCache struct {
+	mu     sync.Mutex
+	counts map[string]int // :: directory URI → number of entries, or -1
+}
+
+// lookup returns the number of entries (files and subdirectories) in each of
+// the given directories, keyed by directory URI.  Only the directories not
+// already in the cache are read.  The lookups are best-effort: a directory
+// that cannot be read is logged and counted as -1.
+func (cc *countCache) lookup(ctx context.Context, api API, dirs []string) map[string]int {
+	cc.mu.Lock()
+	var missing []string
+	for _, dir := range dirs {
+		if _, ok := cc.counts[dir]; !ok {
+			missing = append(missing, dir)
+		}
+	}
+	cc.mu.Unlock()
+
+	counts := make([]int, len(missing))
+	forEachLimited(len(missing), func(i int) {
+		reply, err := probeDirectory(ctx, api, missing[i])
+		if err != nil {
+			log.Printf("Skipping count lookup for %q: %v", missing[i], err)
+			counts[i] = -1
+			return
+		}
+		counts[i] = len(reply.Subdirectory) + len(reply.File)
+	})
+
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+	for i, dir := range missing {
+		cc.counts[dir] = counts[i]
+	}
+	m := make(map[string]int)
+	for _, dir := range dirs {
+		m[dir] = cc.counts[dir]
+	}
+	return m
+}
+
+// packageFile returns the ticket of the file among tickets that best
+// represents the Go package they belong to: doc.go if it is present, or else
+// the .go file whose basename sorts first.  It returns "" if there are no Go
+// files among them.
+func packageFile(tickets []string) string {
+	var first, firstName string
+	for _, ticket := range tickets {
+		name, err := ticketBase(ticket)
+		if err != nil || !strings.HasSuffix(name, ".go") {
+			continue
+		} else if name == "doc.go" {
+			return ticket
+		} else if first == "" || name < firstName {
+			first, firstName = ticket, name
+		}
+	}
+	return first
+}
+
+// formatSize returns n as a string, scaled to human-readable units if --human
+// is set.
+func (c lsCommand) formatSize(n int64) string {
+	if !c.human || n < 1024 {
+		return strconv.FormatInt(n, 10)
+	}
+	v := float64(n)
+	for _, unit := range "KMGTPE" {
+		v /= 1024
+		if v < 1024 || unit == 'E' {
+			if v < 10 {
+				return fmt.Sprintf("%.1f%c", v, unit)
+			}
+			return fmt.Sprintf("%.0f%c", v, unit)
+		}
+	}
+	panic("unreachable")
+}
+
+// directory returns the contents of the given directory, restricted to the
+// entries selected by c.  If further entries are cut off by --limit, next is
+// the cursor from which the next page starts.
+func (c lsCommand) directory(ctx context.Context, api API, corpus, root, path string) (dir *ftpb.DirectoryReply, next string, err error) {
 	req := &ftpb.DirectoryRequest{
 		Corpus: corpus,
 		Root:   root,
 		Path:   path,
 	}
 	LogRequest(req)
-	dir, err := api.FileTreeService.Directory(ctx, req)
+	reply, err := api.FileTreeService.Directory(ctx, req)
 	if err != nil {
-		return err
+		return nil, "", err
 	}
 
+	// Restrict a copy of the reply, since the service may retain the original.
+	dir = &ftpb.DirectoryReply{Subdirectory: reply.Subdirectory, File: reply.File}
+
 	if c.filesOnly {
 		dir.Subdirectory = nil
 	} else if c.dirsOnly {
 		dir.File = nil
 	}
+	if len(c.excludes) > 0 {
+		dir.Subdirectory = c.excludeTickets(dir.Subdirectory)
+		dir.File = c.excludeTickets(dir.File)
+	}
 
-	return c.displayDirectory(dir)
+	if c.pageAfter != "" || c.pageBefore != "" || c.pageLimit > 0 {
+		next, err = pageDirectory(dir, c.pageAfter, c.pageBefore, c.pageLimit)
+		if err != nil {
+			return nil, "", err
+		}
+	}
+	return dir, next, nil
 }
 
-func (c lsCommand) displayCorpusRoots(cr *ftpb.CorpusRootsReply) error {
+// A globList is a flag.Value that collects a list of glob patterns, one for
+// each time the flag is given.
+type globList []string
+
+func (g *globList) String() string     { return strings.Join(*g, ",") }
+func (g *globList) Set(v string) error { *g = append(*g, v); return nil }
+
+// excluded reports whether an entry with the given basename is excluded by
+// --exclude.
+func (c lsCommand) excluded(name string) bool {
+	for _, glob := range c.excludes {
+		if ok, _ := filepath.Match(glob, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// excludeTickets returns the tickets whose basenames are not excluded by
+// --exclude.  Invalid tickets are kept, to be reported when displayed.
+func (c lsCommand) excludeTickets(tickets []string) []string {
+	var kept []string
+	for _, ticket := range tickets {
+		if name, err := ticketBase(ticket); err != nil || !c.excluded(name) {
+			kept = append(kept, ticket)
+		}
+	}
+	return kept
+}
+
+// runBatch lists each of the directories whose URIs are read from stdin, one
+// per line.  A directory that cannot be listed is reported and skipped, so
+// that it does not abort the rest of the batch.  Each directory is listed as
+// it would be on its own, with the same options.  In text mode, each listing is
+// preceded by a header naming its URI; in JSON mode, a single array of the
+// listings is displayed.
+func (c lsCommand) runBatch(ctx context.Context, api API) error {
+	type listing struct {
+		URI       string          `json:"uri"`
+		Directory json.RawMessage `json:"directory,omitempty"`
+		Error     string          `json:"error,omitempty"`
+	}
+	var listings []listing
+	var total, failed int
+
+	s := bufio.NewScanner(in)
+	for s.Scan() {
+		dirURI := strings.TrimSpace(s.Text())
+		if dirURI == "" {
+			continue
+		}
+		total++
+
+		var err error
+		if DisplayJSON {
+			l := listing{URI: dirURI}
+			var msg []byte
+			if msg, err = c.listJSON(ctx, api, dirURI); err != nil {
+				l.Error = err.Error()
+			} else if len(msg) > 0 {
+				l.Directory = json.RawMessage(msg)
+			}
+			listings = append(listings, l)
+		} else {
+			if total > 1 {
+				fmt.Fprintln(out)
+			}
+			fmt.Fprintf(out, "%s:\n", dirURI)
+			err = c.list(ctx, api, dirURI)
+		}
+		if err != nil {
+			log.Printf("ERROR: listing %q: %v", dirURI, err)
+			failed++
+		}
+	}
+	if err := s.Err(); err != nil {
+		return fmt.Errorf("reading directory URIs: %v", err)
+	}
+
 	if DisplayJSON {
+		if err := PrintJSON(listings); err != nil {
+			return err
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("failed to list %d of %d directories", failed, total)
+	}
+	return nil
+}
+
+// listJSON lists the directory with the given URI as list does in JSON mode,
+// and returns the JSON message that would have been displayed, if any, rather
+// than displaying it.
+func (c lsCommand) listJSON(ctx context.Context, api API, dirURI string) ([]byte, error) {
+	var buf bytes.Buffer
+	defer func(w io.Writer) { out = w }(out)
+	out = &buf
+	err := c.list(ctx, api, dirURI)
+	return bytes.TrimSpace(buf.Bytes()), err
+}
+
+// pageDirectory restricts d to the entries whose basenames sort strictly after
+// after and strictly before before, either of which may be "" to leave that
+// end of the range open. Subdirectories and files are paged together in
+// basename order and at most limit entries are kept, if limit > 0.  If the
+// limit cut off any further entries, the basename of the last entry kept is
+// returned as the cursor from which the next page starts; otherwise next is "".
+//
+// Paging is done here over the complete DirectoryReply, since the filetree
+// service does not (yet) support it.  Once DirectoryRequest can carry paging
+// bounds, this is the only place that needs to change.
+func pageDirectory(d *ftpb.DirectoryReply, after, before string, limit int) (next string, err error) {
+	entries, err := flatDirectory(d)
+	if err != nil {
+		return "", err
+	}
+	sortByName(entries)
+
+	var kept []dirEntry
+	for _, e := range entries {
+		name := e.name()
+		if (after != "" && name <= after) || (before != "" && name >= before) {
+			continue
+		} else if limit > 0 && len(kept) == limit {
+			setDirectory(d, kept)
+			return next, nil
+		}
+		kept = append(kept, e)
+		next = name
+	}
+	setDirectory(d, kept)
+	return "", nil
+}
+
+// A dirEntry is a single subdirectory or file of a DirectoryReply.
+type dirEntry struct {
+	ticket string
+	uri    *kytheuri.URI // parsed from ticket
+	isDir  bool
+}
+
+// name returns the basename of e.
+func (e dirEntry) name() string { return filepath.Base(e.uri.Path) }
+
+// flatDirectory returns the entries of d as a single list: its subdirectories
+// followed by its files, each in the order given by d.  An error is reported
+// for the first entry whose URI is malformed.
+func flatDirectory(d *ftpb.DirectoryReply) ([]dirEntry, error) {
+	entries := make([]dirEntry, 0, len(d.Subdirectory)+len(d.File))
+	for _, dir := range d.Subdirectory {
+		uri, err := kytheuri.Parse(dir)
+		if err != nil {
+			return nil, fmt.Errorf("received invalid directory uri %q: %v", dir, err)
+		}
+		entries = append(entries, dirEntry{ticket: dir, uri: uri, isDir: true})
+	}
+	for _, file := range d.File {
+		uri, err := kytheuri.Parse(file)
+		if err != nil {
+			return nil, fmt.Errorf("received invalid file ticket %q: %v", file, err)
+		}
+		entries = append(entries, dirEntry{ticket: file, uri: uri})
+	}
+	return entries, nil
+}
+
+// setDirectory replaces the contents of d with entries, as the inverse of
+// flatDirectory.  The relative order of the subdirectories and of the files
+// among entries is preserved.
+func setDirectory(d *ftpb.DirectoryReply, entries []dirEntry) {
+	d.Subdirectory, d.File = nil, nil
+	for _, e := range entries {
+		if e.isDir {
+			d.Subdirectory = append(d.Subdirectory, e.ticket)
+		} else {
+			d.File = append(d.File, e.ticket)
+		}
+	}
+}
+
+// sortByName sorts entries by basename, without regard to whether they are
+// subdirectories or files.  The sort is stable, so entries with the same name
+// keep their relative order.
+func sortByName(entries []dirEntry) {
+	sort.SliceStable(entries, func(i, j int) bool { return entries[i].name() < entries[j].name() })
+}
+
+// ticketBase returns the basename of the path in the given Kythe URI.
+func ticketBase(ticket string) (string, error) {
+	uri, err := kytheuri.Parse(ticket)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Base(uri.Path), nil
+}
+
+// A treeEntry is a single file or directory visited by a recursive listing.
+type treeEntry struct {
+	ticket string
+	rel    string // path relative to the listed directory
+	isDir  bool
+	depth  int // 1 for the entries of the listed directory
+}
+
+// walkTree recursively calls visit for each entry in the given directory.  The
+// entries of each directory are visited in basename order, and the directories
+// themselves are visited in the order given by c.traversal: "dfs" visits the
+// contents of each subdirectory immediately after the subdirectory itself, and
+// "bfs" visits every entry at one depth before any entry at the next.
+//
+// If --hide_empty is set, directories are skipped unless some file below them
+// is visited.  This requires the whole tree to be read before any entry is
+// visited.
+//
+// Once ctx ends, no further directories are read and the walk returns ctx's
+// error.  The entries read before then are still visited, so that a listing
+// interrupted by a deadline displays its partial results.  These are the
+// leading entries of the listing in the usual order, except that with
+// --hide_empty a directory may be shown even though the files that made it
+// nonempty were never read.
+func (c lsCommand) walkTree(ctx context.Context, api API, corpus, root, path string, visit func(treeEntry) error) error {
+	if !c.hideEmpty {
+		return c.traverseTree(ctx, api, corpus, root, path, treeVisitor{visit: visit})
+	}
+
+	var entries []treeEntry
+	nonEmpty := make(map[string]bool) // :: relative path → has visible files
+	walkErr := c.traverseTree(ctx, api, corpus, root, path, treeVisitor{visit: func(e treeEntry) error {
+		entries = append(entries, e)
+		if !e.isDir {
+			for dir := filepath.Dir(e.rel); dir != "." && !nonEmpty[dir]; dir = filepath.Dir(dir) {
+				nonEmpty[dir] = true
+			}
+		}
+		return nil
+	}})
+	if !partialWalk(ctx, walkErr) {
+		return walkErr
+	}
+	for _, e := range entries {
+		if e.isDir && !nonEmpty[e.rel] {
+			continue
+		} else if err := visit(e); err != nil {
+			return err
+		}
+	}
+	return walkErr
+}
+
+// partialWalk reports whether err, the result of walkTree, leaves partial
+// results to be displayed: either the walk succeeded, or it was cut short
+// because ctx ended.
+func partialWalk(ctx context.Context, err error) bool {
+	return err == nil || ctx.Err() != nil
+}
+
+// A treeVisitor receives the entries of a recursive walk.  Each entry is
+// passed to visit.  If enter and exit are set, they are also called for each
+// directory, including the top-level one, just before and just after the
+// entries it contains are visited.
+type treeVisitor struct {
+	enter, exit func(dir treeEntry) error
+	visit       func(e treeEntry) error
+}
+
+// visitDir reads the entries of dir and passes them to v, between calls to
+// v.enter and v.exit.  It returns the subdirectories of dir, in order.
+func (c lsCommand) visitDir(ctx context.Context, api API, corpus, root, path string, dir treeEntry, v treeVisitor) ([]treeEntry, error) {
+	entries, err := c.readTreeDir(ctx, api, corpus, root, path, dir)
+	if err != nil {
+		return nil, err
+	}
+	if v.enter != nil {
+		if err := v.enter(dir); err != nil {
+			return nil, err
+		}
+	}
+	var subdirs []treeEntry
+	for _, e := range entries {
+		if err := v.visit(e); err != nil {
+			return nil, err
+		} else if e.isDir {
+			subdirs = append(subdirs, e)
+		}
+	}
+	if v.exit != nil {
+		if err := v.exit(dir); err != nil {
+			return nil, err
+		}
+	}
+	return subdirs, nil
+}
+
+// traverseTree implements walkTree without regard to --hide_empty.
+func (c lsCommand) traverseTree(ctx context.Context, api API, corpus, root, path string, v treeVisitor) error {
+	uri := kytheuri.URI{Corpus: corpus, Root: root, Path: path}
+	top := treeEntry{ticket: uri.String(), isDir: true}
+	if c.traversal == "bfs" {
+		queue := []treeEntry{top}
+		for len(queue) > 0 {
+			subdirs, err := c.visitDir(ctx, api, corpus, root, path, queue[0], v)
+			if err != nil {
+				return err
+			}
+			queue = append(queue[1:], subdirs...)
+		}
+		return nil
+	}
+
+	// With dfs, each subdirectory is walked as soon as it has been visited,
+	// before the rest of the entries of its parent.
+	var walk func(dir treeEntry) error
+	walk = func(dir treeEntry) error {
+		inner := v
+		inner.visit = func(e treeEntry) error {
+			if err := v.visit(e); err != nil {
+				return err
+			} else if e.isDir {
+				return walk(e)
+			}
+			return nil
+		}
+		_, err := c.visitDir(ctx, api, corpus, root, path, dir, inner)
+		return err
+	}
+	return walk(top)
+}
+
+// readTreeDir returns the entries of the directory dir, relative to the
+// top-level directory path, sorted by basename.  Entries excluded by
+// --exclude are omitted, so the contents of excluded directories are not
+// read.
+func (c lsCommand) readTreeDir(ctx context.Context, api API, corpus, root, path string, dir treeEntry) ([]treeEntry, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	req := &ftpb.DirectoryRequest{
+		Corpus: corpus,
+		Root:   root,
+		Path:   filetree.CleanDirPath(filepath.Join(path, dir.rel)),
+	}
+	LogRequest(req)
+	reply, err := api.FileTreeService.Directory(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+
+	var entries []treeEntry
+	for _, d := range reply.Subdirectory {
+		name, err := ticketBase(d)
+		if err != nil {
+			return nil, fmt.Errorf("received invalid directory uri %q: %v", d, err)
+		}
+		if !c.excluded(name) {
+			entries = append(entries, treeEntry{d, filepath.Join(dir.rel, name), true, dir.depth + 1})
+		}
+	}
+	for _, f := range reply.File {
+		name, err := ticketBase(f)
+		if err != nil {
+			return nil, fmt.Errorf("received invalid file ticket %q: %v", f, err)
+		}
+		if !c.excluded(name) {
+			entries = append(entries, treeEntry{f, filepath.Join(dir.rel, name), false, dir.depth + 1})
+		}
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].rel < entries[j].rel })
+	return entries, nil
+}
+
+func (c lsCommand) displayTreeEntry(e treeEntry) error {
+	if (c.filesOnly && e.isDir) || (c.dirsOnly && !e.isDir) {
+		return nil
+	} else if DisplayJSON {
+		return PrintJSON(e.ticket)
+	}
+
+	name := e.rel
+	if c.lsURIs {
+		name = e.ticket
+	} else {
+		if c.absolute {
+			uri, err := kytheuri.Parse(e.ticket)
+			if err != nil {
+				return fmt.Errorf("received invalid uri %q: %v", e.ticket, err)
+			}
+			name = uri.Path
+		}
+		if e.isDir {
+			name += "/"
+		}
+	}
+	if c.showLangs && !e.isDir {
+		var err error
+		name, err = withLanguage(name, e.ticket)
+		if err != nil {
+			return err
+		}
+	}
+	if c.withDepth {
+		name = strconv.Itoa(e.depth) + "\t" + name
+	}
+	_, err := fmt.Fprintln(out, name)
+	return err
+}
+
+// treeGlyphs are the strings drawn before each entry of a --tree listing to
+// show its place in the tree.
+type treeGlyphs struct {
+	entry, last string // before an entry; before the last entry in its directory
+	more, done  string // below an entry; below the last entry in its directory
+}
+
+var (
+	unicodeGlyphs = treeGlyphs{"├── ", "└── ", "│   ", "    "}
+	asciiGlyphs   = treeGlyphs{"|-- ", "`-- ", "|   ", "    "}
+)
+
+// displayTree displays the entries below the directory at path as an indented
+// tree, like tree(1), followed by the numbers of directories and files
+// displayed.  The subdirectories of each directory are displayed before its
+// files, each in basename order.
+//
+// With --dirs, files are omitted.  With --files, directories are displayed
+// only to show the structure of the tree, so those with no files below them
+// are omitted, as for --hide_empty.
+func (c lsCommand) displayTree(ctx context.Context, api API, corpus, root, path string) error {
+	trie := newPathTrie(path)
+	walker := c
+	walker.hideEmpty = c.hideEmpty || c.filesOnly
+	walkErr := walker.walkTree(ctx, api, corpus, root, path, func(e treeEntry) error {
+		if c.dirsOnly && !e.isDir {
+			return nil
+		}
+		return trie.add(e.ticket, e.isDir)
+	})
+	if !partialWalk(ctx, walkErr) {
+		return walkErr
+	}
+
+	glyphs := unicodeGlyphs
+	if c.ascii {
+		glyphs = asciiGlyphs
+	}
+	var dirs, files int
+	var display func(dir *pathNode, indent string) error
+	display = func(dir *pathNode, indent string) error {
+		entries := dir.sortedChildren()
+		for i, e := range entries {
+			branch, below := glyphs.entry, glyphs.more
+			if i == len(entries)-1 {
+				branch, below = glyphs.last, glyphs.done
+			}
+			name := e.name
+			if e.isDir {
+				name += "/"
+				dirs++
+			} else {
+				files++
+				if c.showLangs {
+					var err error
+					if name, err = withLanguage(name, e.ticket); err != nil {
+						return err
+					}
+				}
+			}
+			if _, err := fmt.Fprintln(out, indent+branch+name); err != nil {
+				return err
+			}
+			if e.isDir {
+				if err := display(e, indent+below); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	}
+
+	top := "."
+	if path != "" {
+		top = path + "/"
+	}
+	if _, err := fmt.Fprintln(out, top); err != nil {
+		return err
+	} else if err := display(&trie.root, ""); err != nil {
+		return err
+	}
+	if _, err := fmt.Fprintf(out, "\n%s, %s\n", plural(dirs, "directory", "directories"), plural(files, "file", "files")); err != nil {
+		return err
+	}
+	return walkErr
+}
+
+// A pathNode is a node of a pathTrie: a file or directory of a recursive
+// listing, below which are the entries of that directory.
+type pathNode struct {
+	name     string // basename; "" for the root
+	ticket   string // "" for a directory inferred from the entries below it
+	isDir    bool
+	children map[string]*pathNode // :: basename → entry
+}
+
+// A pathTrie organizes the entries of a recursive listing by the components
+// of their paths, relative to the listed directory.  Entries may be added at
+// any depth and in any order; the directories above an entry are created as
+// needed, and take their tickets from their own entries if those are added.
+type pathTrie struct {
+	base string   // the clean path of the listed directory
+	root pathNode // the listed directory
+}
+
+// newPathTrie returns an empty trie of the entries below the directory with
+// the given corpus-relative path.
+func newPathTrie(path string) *pathTrie {
+	return &pathTrie{base: filetree.CleanDirPath(path), root: pathNode{isDir: true}}
+}
+
+// add adds the entry with the given ticket to t.  It reports an error if the
+// ticket is malformed or does not denote a path below the listed directory.
+func (t *pathTrie) add(ticket string, isDir bool) error {
+	uri, err := kytheuri.Parse(ticket)
+	if err != nil {
+		return fmt.Errorf("received invalid uri %q: %v", ticket, err)
+	}
+	rel := filetree.CleanDirPath(uri.Path)
+	if t.base != "" {
+		if !strings.HasPrefix(rel, t.base+"/") {
+			return fmt.Errorf("entry %q is not below %q", ticket, t.base)
+		}
+		rel = strings.TrimPrefix(rel, t.base+"/")
+	}
+	if rel == "" {
+		return fmt.Errorf("entry %q is not below %q", ticket, t.base)
+	}
+
+	node := &t.root
+	for _, part := range strings.Split(rel, "/") {
+		child := node.children[part]
+		if child == nil {
+			if node.children == nil {
+				node.children = make(map[string]*pathNode)
+			}
+			child = &pathNode{name: part, isDir: true}
+			node.children[part] = child
+		}
+		node = child
+	}
+	node.ticket, node.isDir = ticket, isDir
+	return nil
+}
+
+// sortedChildren returns the entries of n, subdirectories before files and
+// each in basename order.
+func (n *pathNode) sortedChildren() []*pathNode {
+	entries := make([]*pathNode, 0, len(n.children))
+	for _, child := range n.children {
+		entries = append(entries, child)
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].isDir != entries[j].isDir {
+			return entries[i].isDir
+		}
+		return entries[i].name < entries[j].name
+	})
+	return entries
+}
+
+// plural returns n followed by the singular or plural form of a noun, as
+// appropriate for n.
+func plural(n int, singular, plural string) string {
+	if n == 1 {
+		return "1 " + singular
+	}
+	return strconv.Itoa(n) + " " + plural
+}
+
+// displayCount displays the number of entries listed, given the numbers of
+// directories and files found, excluding those not selected by --files or
+// --dirs.  In JSON mode, the counts of directories and files are displayed
+// separately.
+func (c lsCommand) displayCount(dirs, files int) error {
+	if c.filesOnly {
+		dirs = 0
+	} else if c.dirsOnly {
+		files = 0
+	}
+	if DisplayJSON {
+		return PrintJSON(struct {
+			Directories int `json:"directories"`
+			Files       int `json:"files"`
+		}{dirs, files})
+	}
+	_, err := fmt.Fprintln(out, dirs+files)
+	return err
+}
+
+// entriesJSON is the --format value that selects a flattened JSON listing,
+// whose shape does not depend on that of the DirectoryReply message.
+const entriesJSON = "entries-json"
+
+// eventsNDJSON is the --format value that selects a recursive listing as a
+// stream of JSON events, one per line, written as the walk proceeds.
+const eventsNDJSON = "ndjson-events"
+
+// A treeEvent is a single event of an ndjson-events listing.
+type treeEvent struct {
+	Event string `json:"event"` // "enter_dir", "file", or "exit_dir"
+	URI   string `json:"uri"`
+}
+
+// displayEvents displays a recursive listing of the given directory as a
+// stream of treeEvents: each directory, starting with the listed one, has an
+// enter_dir event before the events for its contents and an exit_dir event
+// after them, and each file has a file event.  With --traversal bfs, the
+// contents of a directory's subdirectories follow its exit_dir event.  Each
+// event is written as soon as it happens, so if the walk fails or ctx ends,
+// the events so far have already been displayed.
+func (c lsCommand) displayEvents(ctx context.Context, api API, corpus, root, path string) error {
+	event := func(kind string) func(treeEntry) error {
+		return func(e treeEntry) error { return PrintJSON(treeEvent{kind, e.ticket}) }
+	}
+	return c.traverseTree(ctx, api, corpus, root, path, treeVisitor{
+		enter: event("enter_dir"),
+		exit:  event("exit_dir"),
+		visit: func(e treeEntry) error {
+			if e.isDir {
+				return nil // displayed when it is entered
+			}
+			return PrintJSON(treeEvent{"file", e.ticket})
+		},
+	})
+}
+
+// An lsEntry is a single file or directory of an entries-json listing.
+type lsEntry struct {
+	Name string `json:"name"`
+	URI  string `json:"uri"`
+	Kind string `json:"kind"` // "directory" or "file"
+}
+
+func newLSEntry(name, ticket string, isDir bool) lsEntry {
+	if isDir {
+		return lsEntry{Name: name, URI: ticket, Kind: "directory"}
+	}
+	return lsEntry{Name: name, URI: ticket, Kind: "file"}
+}
+
+// directoryEntries returns the entries of d, named as they would be displayed
+// in plain text.
+func (c lsCommand) directoryEntries(d *ftpb.DirectoryReply) ([]lsEntry, error) {
+	flat, err := flatDirectory(d)
+	if err != nil {
+		return nil, err
+	}
+	var entries []lsEntry
+	for _, e := range flat {
+		entries = append(entries, newLSEntry(c.plainName(e.uri.Path), e.ticket, e.isDir))
+	}
+	return entries, nil
+}
+
+// displayEntries displays entries as an entries-json listing, sorted by name
+// and then by URI.  If next != "", it is included as the cursor from which the
+// next page of the listing starts.
+func displayEntries(entries []lsEntry, next string) error {
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].Name != entries[j].Name {
+			return entries[i].Name < entries[j].Name
+		}
+		return entries[i].URI < entries[j].URI
+	})
+	if entries == nil {
+		entries = []lsEntry{} // display [] rather than null
+	}
+	return PrintJSON(struct {
+		Entries []lsEntry `json:"entries"`
+		Next    string    `json:"next,omitempty"`
+	}{entries, next})
+}
+
+// unknownLanguage is the language under which --by_lang counts files whose
+// tickets have no language.
+const unknownLanguage = "unknown"
+
+// displayLanguages displays the number of the given file tickets in each
+// language, in decreasing order of count and then by language.  In JSON mode,
+// the counts are displayed as an object keyed by language.
+func displayLanguages(files []string) error {
+	counts := make(map[string]int) // :: language → count
+	for _, file := range files {
+		uri, err := kytheuri.Parse(file)
+		if err != nil {
+			return fmt.Errorf("received invalid file ticket %q: %v", file, err)
+		}
+		lang := uri.Language
+		if lang == "" {
+			lang = unknownLanguage
+		}
+		counts[lang]++
+	}
+	if DisplayJSON {
+		return PrintJSON(counts)
+	}
+
+	langs := make([]string, 0, len(counts))
+	for lang := range counts {
+		langs = append(langs, lang)
+	}
+	sort.Slice(langs, func(i, j int) bool {
+		if counts[langs[i]] != counts[langs[j]] {
+			return counts[langs[i]] > counts[langs[j]]
+		}
+		return langs[i] < langs[j]
+	})
+	for _, lang := range langs {
+		if _, err := fmt.Fprintf(out, "%s: %d\n", lang, counts[lang]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// noLanguage is displayed by --lang for files whose tickets have no language.
+const noLanguage = "-"
+
+// withLanguage returns name followed by a tab and the language of the given
+// file ticket, or noLanguage if the ticket does not specify one.
+func withLanguage(name, ticket string) (string, error) {
+	uri, err := kytheuri.Parse(ticket)
+	if err != nil {
+		return "", fmt.Errorf("received invalid file ticket %q: %v", ticket, err)
+	}
+	lang := uri.Language
+	if lang == "" {
+		lang = noLanguage
+	}
+	return name + "\t" + lang, nil
+}
+
+// rootsJSON is the --format value that selects a flattened JSON listing of the
+// corpus roots, whose shape does not depend on that of the CorpusRootsReply
+// message.
+const rootsJSON = "roots-json"
+
+// nonEmptyRoots returns a copy of cr without the roots whose top-level
+// directories are empty, and without the corpora left with no roots.  A root
+// whose directory cannot be read is logged and kept.
+func nonEmptyRoots(ctx context.Context, api API, cr *ftpb.CorpusRootsReply) *ftpb.CorpusRootsReply {
+	type probe struct{ i, j int } // root j of corpus i
+	var probes []probe
+	empty := make([][]bool, len(cr.Corpus))
+	for i, corpus := range cr.Corpus {
+		empty[i] = make([]bool, len(corpus.Root))
+		for j := range corpus.Root {
+			probes = append(probes, probe{i, j})
+		}
+	}
+	forEachLimited(len(probes), func(k int) {
+		i, j := probes[k].i, probes[k].j
+		corpus, root := cr.Corpus[i].Name, cr.Corpus[i].Root[j]
+		top := kytheuri.URI{Corpus: corpus, Root: root}
+		reply, err := probeDirectory(ctx, api, top.String())
+		if err != nil {
+			log.Printf("Keeping root %q of corpus %q, which could not be read: %v", root, corpus, err)
+			return
+		}
+		empty[i][j] = len(reply.Subdirectory) == 0 && len(reply.File) == 0
+	})
+
+	filtered := &ftpb.CorpusRootsReply{}
+	for i, corpus := range cr.Corpus {
+		var roots []string
+		for j, root := range corpus.Root {
+			if !empty[i][j] {
+				roots = append(roots, root)
+			}
+		}
+		if len(roots) > 0 {
+			filtered.Corpus = append(filtered.Corpus, &ftpb.CorpusRootsReply_Corpus{
+				Name: corpus.Name,
+				Root: roots,
+			})
+		}
+	}
+	return filtered
+}
+
+// A corpusRoot is a single root of a roots-json listing.
+type corpusRoot struct {
+	Corpus string `json:"corpus"`
+	Root   string `json:"root"`
+}
+
+func (c lsCommand) displayCorpusRoots(cr *ftpb.CorpusRootsReply) error {
+	if c.format == rootsJSON {
+		roots := []corpusRoot{} // display [] rather than null
+		for _, corpus := range cr.Corpus {
+			for _, root := range corpus.Root {
+				roots = append(roots, corpusRoot{corpus.Name, root})
+			}
+		}
+		sort.Slice(roots, func(i, j int) bool {
+			if roots[i].Corpus != roots[j].Corpus {
+				return roots[i].Corpus < roots[j].Corpus
+			}
+			return roots[i].Root < roots[j].Root
+		})
+		return PrintJSON(roots)
+	} else if DisplayJSON {
 		return PrintJSONMessage(cr)
 	}
 
@@ -116,34 +1549,121 @@ func (c lsCommand) displayCorpusRoots(cr *ftpb.CorpusRootsReply) error {
 	return nil
 }
 
-func (c lsCommand) displayDirectory(d *ftpb.DirectoryReply) error {
+// plainName returns the name displayed for the entry with the given path,
+// unless URIs are requested: its full corpus-relative path if --absolute is
+// set, and its basename otherwise.
+func (c lsCommand) plainName(path string) string {
+	if c.absolute {
+		return path
+	}
+	return filepath.Base(path)
+}
+
+// displayDirectory displays the contents of d.  If sizes != nil, it gives the
+// size of each file, which is displayed along with the total size of the files.
+// If packages != nil, it gives the representative file of each subdirectory
+// that is a Go package, which is displayed after the subdirectory's name.  If
+// counts != nil, it gives the number of entries in each subdirectory, or -1 if
+// that is unknown, which is displayed after the subdirectory's name and before
+// its representative file.
+//
+// If next != "", it is the cursor from which the next page of the listing
+// starts, which is displayed on a line after the entries, or in JSON mode as
+// the "next" field of the directory.
+func (c lsCommand) displayDirectory(d *ftpb.DirectoryReply, next string, sizes map[string]int64, packages map[string]string, counts map[string]int) error {
+	var total int64
+	for _, size := range sizes {
+		total += size
+	}
+
 	if DisplayJSON {
-		return PrintJSONMessage(d)
+		dir, err := encodeDirectory(d, next)
+		if err != nil {
+			return err
+		} else if sizes == nil {
+			return PrintJSON(dir)
+		}
+		return PrintJSON(struct {
+			Directory json.RawMessage  `json:"directory"`
+			Sizes     map[string]int64 `json:"sizes"`
+			Total     int64            `json:"total"`
+		}{dir, sizes, total})
 	}
 
-	for _, d := range d.Subdirectory {
+	entries, err := flatDirectory(d)
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		name := e.ticket
 		if !c.lsURIs {
-			uri, err := kytheuri.Parse(d)
-			if err != nil {
-				return fmt.Errorf("received invalid directory uri %q: %v", d, err)
+			name = c.plainName(e.uri.Path)
+			if e.isDir {
+				name += "/"
+			}
+		}
+		if e.isDir {
+			if sizes != nil {
+				name = "-\t" + name
+			}
+			if n, ok := counts[e.ticket]; ok {
+				if n < 0 {
+					name += "\t?"
+				} else {
+					name += "\t" + strconv.Itoa(n)
+				}
+			}
+			if file, ok := packages[e.ticket]; ok {
+				if !c.lsURIs {
+					uri, err := kytheuri.Parse(file)
+					if err != nil {
+						return fmt.Errorf("received invalid file ticket %q: %v", file, err)
+					}
+					file = c.plainName(uri.Path)
+				}
+				name += "\t" + file
+			}
+		} else {
+			if c.showLangs {
+				if name, err = withLanguage(name, e.ticket); err != nil {
+					return err
+				}
+			}
+			if sizes != nil {
+				name = c.formatSize(sizes[e.ticket]) + "\t" + name
 			}
-			d = filepath.Base(uri.Path) + "/"
 		}
-		if _, err := fmt.Fprintln(out, d); err != nil {
+		if _, err := fmt.Fprintln(out, name); err != nil {
 			return err
 		}
 	}
-	for _, f := range d.File {
-		if !c.lsURIs {
-			uri, err := kytheuri.Parse(f)
-			if err != nil {
-				return fmt.Errorf("received invalid file ticket %q: %v", f, err)
-			}
-			f = filepath.Base(uri.Path)
+	if sizes != nil {
+		if _, err := fmt.Fprintf(out, "%s\ttotal\n", c.formatSize(total)); err != nil {
+			return err
 		}
-		if _, err := fmt.Fprintln(out, f); err != nil {
+	}
+	if next != "" {
+		if _, err := fmt.Fprintf(out, "Next page cursor: --after %q\n", next); err != nil {
 			return err
 		}
 	}
 	return nil
 }
+
+// encodeDirectory returns the JSON encoding of d, with next added as its
+// "next" field if it is not "".
+func encodeDirectory(d *ftpb.DirectoryReply, next string) (json.RawMessage, error) {
+	dir, err := jsonMarshaler.MarshalToString(d)
+	if err != nil || next == "" {
+		return json.RawMessage(dir), err
+	}
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal([]byte(dir), &fields); err != nil {
+		return nil, err
+	}
+	fields["next"], err = json.Marshal(next)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(fields)
+}
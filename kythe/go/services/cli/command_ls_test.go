@@ -0,0 +1,1300 @@
+/*
+ * Copyright 2017 Google Inc. All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package cli
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"kythe.io/kythe/go/platform/delimited"
+	"kythe.io/kythe/go/services/filetree"
+	"kythe.io/kythe/go/services/xrefs"
+	"kythe.io/kythe/go/test/testutil"
+	"kythe.io/kythe/go/util/kytheuri"
+	"kythe.io/kythe/go/util/schema/edges"
+	"kythe.io/kythe/go/util/schema/facts"
+	"kythe.io/kythe/go/util/schema/nodes"
+
+	cpb "kythe.io/kythe/proto/common_proto"
+	ftpb "kythe.io/kythe/proto/filetree_proto"
+	gpb "kythe.io/kythe/proto/graph_proto"
+	spb "kythe.io/kythe/proto/storage_proto"
+	xpb "kythe.io/kythe/proto/xref_proto"
+)
+
+// testTree returns a filetree service containing a file for each of the given
+// corpus-relative paths in the "kythe" corpus.
+func testTree(paths ...string) *filetree.Map {
+	m := filetree.NewMap()
+	for _, path := range paths {
+		m.AddFile(&spb.VName{Corpus: "kythe", Path: path})
+	}
+	return m
+}
+
+// runLS runs c with the given arguments against ft and returns its output.
+func runLS(t *testing.T, c lsCommand, ft filetree.Service, args ...string) (string, error) {
+	return runLSWithAPI(t, c, API{FileTreeService: ft}, args...)
+}
+
+// runLSWithAPI runs c with the given arguments against api and returns its
+// output.
+func runLSWithAPI(t *testing.T, c lsCommand, api API, args ...string) (string, error) {
+	return runLSWithContext(context.Background(), t, c, api, args...)
+}
+
+// runLSWithContext runs c with the given arguments against api in ctx and
+// returns its output.
+func runLSWithContext(ctx context.Context, t *testing.T, c lsCommand, api API, args ...string) (string, error) {
+	var buf bytes.Buffer
+	defer func(w io.Writer) { out = w }(out)
+	out = &buf
+
+	fs := flag.NewFlagSet("ls", flag.ContinueOnError)
+	if err := fs.Parse(args); err != nil {
+		t.Fatalf("Parsing arguments %q: %v", args, err)
+	}
+	err := c.Run(ctx, fs, api)
+	return buf.String(), err
+}
+
+// entryTicket returns the ticket for the named entry of the "dir" directory in
+// the "kythe" corpus.
+func entryTicket(name string) string {
+	uri := kytheuri.URI{Corpus: "kythe", Path: "dir/" + name}
+	return uri.String()
+}
+
+func TestPageDirectory(t *testing.T) {
+	newReply := func() *ftpb.DirectoryReply {
+		return &ftpb.DirectoryReply{
+			Subdirectory: []string{entryTicket("d"), entryTicket("a")},
+			File:         []string{entryTicket("e.go"), entryTicket("c.go"), entryTicket("b.go")},
+		}
+	}
+
+	tests := []struct {
+		after, before string
+		limit         int
+
+		dirs, files []string
+		next        string
+	}{
+		// The first page.
+		{"", "", 2, []string{"a"}, []string{"b.go"}, "b.go"},
+		// A middle page.
+		{"b.go", "", 2, []string{"d"}, []string{"c.go"}, "d"},
+		// The final (short) page.
+		{"d", "", 2, nil, []string{"e.go"}, ""},
+		// An exact fit does not report a further page.
+		{"", "", 5, []string{"a", "d"}, []string{"b.go", "c.go", "e.go"}, ""},
+		// Both ends bounded.
+		{"a", "e.go", 0, []string{"d"}, []string{"b.go", "c.go"}, ""},
+		{"", "c", 1, []string{"a"}, nil, "a"},
+	}
+	for _, test := range tests {
+		reply := newReply()
+		next, err := pageDirectory(reply, test.after, test.before, test.limit)
+		if err != nil {
+			t.Errorf("pageDirectory(%q, %q, %d): unexpected error: %v", test.after, test.before, test.limit, err)
+			continue
+		}
+		if next != test.next {
+			t.Errorf("pageDirectory(%q, %q, %d): next cursor: got %q, want %q", test.after, test.before, test.limit, next, test.next)
+		}
+
+		var wantDirs, wantFiles []string
+		for _, name := range test.dirs {
+			wantDirs = append(wantDirs, entryTicket(name))
+		}
+		for _, name := range test.files {
+			wantFiles = append(wantFiles, entryTicket(name))
+		}
+		if err := testutil.DeepEqual(wantDirs, reply.Subdirectory); err != nil {
+			t.Errorf("pageDirectory(%q, %q, %d): subdirectories: %v", test.after, test.before, test.limit, err)
+		}
+		if err := testutil.DeepEqual(wantFiles, reply.File); err != nil {
+			t.Errorf("pageDirectory(%q, %q, %d): files: %v", test.after, test.before, test.limit, err)
+		}
+	}
+}
+
+func TestFlatDirectory(t *testing.T) {
+	reply := &ftpb.DirectoryReply{
+		Subdirectory: []string{entryTicket("d"), entryTicket("a")},
+		File:         []string{entryTicket("c.go"), entryTicket("b.go")},
+	}
+	entries, err := flatDirectory(reply)
+	if err != nil {
+		t.Fatalf("flatDirectory: unexpected error: %v", err)
+	}
+
+	// Subdirectories come first, and otherwise the order of the reply is kept.
+	describe := func(entries []dirEntry) []string {
+		var names []string
+		for _, e := range entries {
+			if e.isDir {
+				names = append(names, e.name()+"/")
+			} else {
+				names = append(names, e.name())
+			}
+		}
+		return names
+	}
+	if err := testutil.DeepEqual([]string{"d/", "a/", "c.go", "b.go"}, describe(entries)); err != nil {
+		t.Errorf("flatDirectory: %v", err)
+	}
+	if got, want := entries[0].uri.Path, "dir/d"; got != want {
+		t.Errorf("flatDirectory: path: got %q, want %q", got, want)
+	}
+
+	// Sorting by name interleaves subdirectories and files.
+	sortByName(entries)
+	if err := testutil.DeepEqual([]string{"a/", "b.go", "c.go", "d/"}, describe(entries)); err != nil {
+		t.Errorf("sortByName: %v", err)
+	}
+
+	// Splitting the sorted entries again keeps their order within each group.
+	var split ftpb.DirectoryReply
+	setDirectory(&split, entries)
+	if err := testutil.DeepEqual([]string{entryTicket("a"), entryTicket("d")}, split.Subdirectory); err != nil {
+		t.Errorf("setDirectory: subdirectories: %v", err)
+	}
+	if err := testutil.DeepEqual([]string{entryTicket("b.go"), entryTicket("c.go")}, split.File); err != nil {
+		t.Errorf("setDirectory: files: %v", err)
+	}
+
+	bad := &ftpb.DirectoryReply{File: []string{entryTicket("a.go"), "kythe://kythe?badparam"}}
+	if entries, err := flatDirectory(bad); err == nil {
+		t.Errorf("flatDirectory of a malformed ticket: got %+v, wanted an error", entries)
+	}
+}
+
+func TestPathTrie(t *testing.T) {
+	trie := newPathTrie("dir")
+	for _, e := range []struct {
+		name  string
+		isDir bool
+	}{
+		{"z.go", false},
+		{"a/b/deep.go", false}, // a and a/b are inferred
+		{"a", true},
+		{"a/x.go", false},
+		{"c", true}, // an empty directory
+		{"a/b/c", true},
+	} {
+		if err := trie.add(entryTicket(e.name), e.isDir); err != nil {
+			t.Fatalf("Adding %q: unexpected error: %v", e.name, err)
+		}
+	}
+
+	// Describe the trie as a list of entries, each indented by its depth and
+	// followed by its ticket if it has one.
+	var got []string
+	var describe func(n *pathNode, indent string)
+	describe = func(n *pathNode, indent string) {
+		for _, child := range n.sortedChildren() {
+			line := indent + child.name
+			if child.isDir {
+				line += "/"
+			}
+			if child.ticket != "" {
+				line += " " + child.ticket
+			}
+			got = append(got, line)
+			describe(child, indent+"  ")
+		}
+	}
+	describe(&trie.root, "")
+
+	want := []string{
+		"a/ " + entryTicket("a"),
+		"  b/",
+		"    c/ " + entryTicket("a/b/c"),
+		"    deep.go " + entryTicket("a/b/deep.go"),
+		"  x.go " + entryTicket("a/x.go"),
+		"c/ " + entryTicket("c"),
+		"z.go " + entryTicket("z.go"),
+	}
+	if err := testutil.DeepEqual(want, got); err != nil {
+		t.Errorf("Trie: %v", err)
+	}
+
+	for _, ticket := range []string{"kythe://kythe?path=other/a.go", "kythe://kythe?path=dir", "kythe://kythe?badparam"} {
+		if err := trie.add(ticket, false); err == nil {
+			t.Errorf("Adding %q: got no error, wanted one", ticket)
+		}
+	}
+}
+
+func TestLSPagingFilesOnly(t *testing.T) {
+	ft := testTree("dir/a/x.go", "dir/b.go", "dir/c.go", "dir/d/y.go", "dir/e.go")
+	got, err := runLS(t, lsCommand{filesOnly: true, pageAfter: "b.go", pageLimit: 1}, ft, "kythe://kythe?path=dir")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if want := "c.go\nNext page cursor: --after \"c.go\"\n"; got != want {
+		t.Errorf("ls --files --after b.go --limit 1: got %q, want %q", got, want)
+	}
+
+	if _, err := runLS(t, lsCommand{pageLimit: -1}, ft, "kythe://kythe?path=dir"); err == nil {
+		t.Error("ls --limit -1: got no error, wanted one")
+	} else if !strings.Contains(err.Error(), "--limit") {
+		t.Errorf("ls --limit -1: unexpected error: %v", err)
+	}
+}
+
+func TestLSRecursiveTraversal(t *testing.T) {
+	ft := testTree("dir/a/b/z.go", "dir/a/y.go", "dir/c.go", "dir/d/x.go")
+
+	tests := []struct {
+		c    lsCommand
+		want []string
+	}{{
+		lsCommand{recursive: true, traversal: "dfs"},
+		[]string{"a/", "a/b/", "a/b/z.go", "a/y.go", "c.go", "d/", "d/x.go"},
+	}, {
+		lsCommand{recursive: true, traversal: "bfs"},
+		[]string{"a/", "c.go", "d/", "a/b/", "a/y.go", "d/x.go", "a/b/z.go"},
+	}, {
+		lsCommand{recursive: true, traversal: "bfs", filesOnly: true},
+		[]string{"c.go", "a/y.go", "d/x.go", "a/b/z.go"},
+	}}
+	for _, test := range tests {
+		got, err := runLS(t, test.c, ft, "kythe://kythe?path=dir")
+		if err != nil {
+			t.Errorf("ls --recursive --traversal %s: unexpected error: %v", test.c.traversal, err)
+			continue
+		}
+		if want := strings.Join(test.want, "\n") + "\n"; got != want {
+			t.Errorf("ls --recursive --traversal %s: got:\n%s\nwant:\n%s", test.c.traversal, got, want)
+		}
+	}
+
+	if _, err := runLS(t, lsCommand{recursive: true, traversal: "random"}, ft, "kythe://kythe?path=dir"); err == nil {
+		t.Error("ls --recursive --traversal random: got no error, wanted one")
+	}
+}
+
+func TestLSWithDepth(t *testing.T) {
+	ft := testTree("dir/a/b/z.go", "dir/a/y.go", "dir/c.go")
+
+	tests := []struct {
+		flags string
+		c     lsCommand
+		want  []string
+	}{{
+		"",
+		lsCommand{recursive: true, traversal: "dfs", withDepth: true},
+		[]string{"1\ta/", "2\ta/b/", "3\ta/b/z.go", "2\ta/y.go", "1\tc.go"},
+	}, {
+		" --traversal bfs --dirs",
+		lsCommand{recursive: true, traversal: "bfs", withDepth: true, dirsOnly: true},
+		[]string{"1\ta/", "2\ta/b/"},
+	}, {
+		" --files --uris",
+		lsCommand{recursive: true, traversal: "dfs", withDepth: true, filesOnly: true, lsURIs: true},
+		[]string{"3\tkythe://kythe?path=dir/a/b/z.go", "2\tkythe://kythe?path=dir/a/y.go", "1\tkythe://kythe?path=dir/c.go"},
+	}}
+	for _, test := range tests {
+		got, err := runLS(t, test.c, ft, "kythe://kythe?path=dir")
+		if err != nil {
+			t.Errorf("ls --recursive --with_depth%s: unexpected error: %v", test.flags, err)
+			continue
+		}
+		if want := strings.Join(test.want, "\n") + "\n"; got != want {
+			t.Errorf("ls --recursive --with_depth%s: got:\n%s\nwant:\n%s", test.flags, got, want)
+		}
+	}
+
+	if _, err := runLS(t, lsCommand{withDepth: true}, ft, "kythe://kythe?path=dir"); err == nil {
+		t.Error("ls --with_depth without --recursive: got no error, wanted one")
+	}
+}
+
+func TestLSLanguages(t *testing.T) {
+	ft := filetree.NewMap()
+	for _, file := range []*spb.VName{
+		{Corpus: "kythe", Path: "dir/a.go", Language: "go"},
+		{Corpus: "kythe", Path: "dir/b.proto", Language: "protobuf"},
+		{Corpus: "kythe", Path: "dir/c.cc", Language: "c++"},
+		{Corpus: "kythe", Path: "dir/d.txt"},
+		{Corpus: "kythe", Path: "dir/sub/e.go", Language: "go"},
+	} {
+		ft.AddFile(file)
+	}
+
+	got, err := runLS(t, lsCommand{showLangs: true}, ft, "kythe://kythe?path=dir")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if want := "sub/\na.go\tgo\nb.proto\tprotobuf\nc.cc\tc++\nd.txt\t-\n"; got != want {
+		t.Errorf("ls --lang: got %q, want %q", got, want)
+	}
+
+	got, err = runLS(t, lsCommand{showLangs: true, recursive: true, traversal: "dfs", filesOnly: true}, ft, "kythe://kythe?path=dir")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if want := "a.go\tgo\nb.proto\tprotobuf\nc.cc\tc++\nd.txt\t-\nsub/e.go\tgo\n"; got != want {
+		t.Errorf("ls --lang --recursive --files: got %q, want %q", got, want)
+	}
+}
+
+func TestLSBatch(t *testing.T) {
+	ft := testTree("dir/a.go", "dir/sub/b.go", "other/c.go")
+	defer func(r io.Reader) { in = r }(in)
+	defer func(w io.Writer) { log.SetOutput(w) }(os.Stderr)
+	var logs bytes.Buffer
+	log.SetOutput(&logs)
+
+	const input = "kythe://kythe?path=dir\nkythe://kythe?bogus=dir\n\nkythe://kythe?path=other\n"
+	in = strings.NewReader(input)
+	got, err := runLS(t, lsCommand{batch: true}, ft)
+	if err == nil {
+		t.Error("ls --batch: got no error, wanted one")
+	} else if !strings.Contains(err.Error(), "1 of 3") {
+		t.Errorf("ls --batch: unexpected error: %v", err)
+	}
+
+	const want = `kythe://kythe?path=dir:
+sub/
+a.go
+
+kythe://kythe?bogus=dir:
+
+kythe://kythe?path=other:
+c.go
+`
+	if got != want {
+		t.Errorf("ls --batch: got:\n%s\nwant:\n%s", got, want)
+	}
+	if n := strings.Count(logs.String(), "ERROR"); n != 1 {
+		t.Errorf("ls --batch: got %d errors logged, want 1:\n%s", n, logs.String())
+	}
+
+	DisplayJSON = true
+	defer func() { DisplayJSON = false }()
+	in = strings.NewReader(input)
+	got, _ = runLS(t, lsCommand{batch: true}, ft)
+	var listings []struct {
+		URI       string
+		Directory *ftpb.DirectoryReply
+		Error     string
+	}
+	if err := json.Unmarshal([]byte(got), &listings); err != nil {
+		t.Fatalf("ls --batch --json: invalid output %q: %v", got, err)
+	}
+	if len(listings) != 3 {
+		t.Fatalf("ls --batch --json: got %d listings, want 3: %q", len(listings), got)
+	}
+	for i, l := range listings {
+		if failed := i == 1; (l.Error != "") != failed || (l.Directory == nil) != failed {
+			t.Errorf("ls --batch --json: listing %d: got %+v", i, l)
+		}
+	}
+	if files := listings[2].Directory.GetFile(); len(files) != 1 || !strings.HasSuffix(files[0], "other/c.go") {
+		t.Errorf("ls --batch --json: files of %q: got %+q", listings[2].URI, files)
+	}
+
+	// Each listing is displayed as it would be on its own.
+	in = strings.NewReader("kythe://kythe?path=dir\n")
+	got, err = runLS(t, lsCommand{batch: true, byLang: true}, ft)
+	if err != nil {
+		t.Fatalf("ls --batch --json --by_lang: unexpected error: %v", err)
+	}
+	if want := `[{"uri":"kythe://kythe?path=dir","directory":{"unknown":1}}]` + "\n"; got != want {
+		t.Errorf("ls --batch --json --by_lang: got %q, want %q", got, want)
+	}
+}
+
+func TestLSAbsolute(t *testing.T) {
+	ft := testTree("dir/sub/a.go", "dir/sub/deeper/b.go", "dir/sub/c.go")
+
+	tests := []struct {
+		c    lsCommand
+		want string
+	}{
+		{lsCommand{absolute: true}, "dir/sub/deeper/\ndir/sub/a.go\ndir/sub/c.go\n"},
+		{lsCommand{absolute: true, filesOnly: true}, "dir/sub/a.go\ndir/sub/c.go\n"},
+		{lsCommand{absolute: true, recursive: true, traversal: "dfs"}, "dir/sub/a.go\ndir/sub/c.go\ndir/sub/deeper/\ndir/sub/deeper/b.go\n"},
+	}
+	for _, test := range tests {
+		got, err := runLS(t, test.c, ft, "kythe://kythe?path=dir/sub")
+		if err != nil {
+			t.Errorf("ls %+v: unexpected error: %v", test.c, err)
+		} else if got != test.want {
+			t.Errorf("ls %+v: got %q, want %q", test.c, got, test.want)
+		}
+	}
+}
+
+// textService is a fake xrefs.Service whose nodes have the given text.
+type textService struct {
+	xrefs.Service
+	text map[string]string // :: ticket → text
+}
+
+func (s textService) Nodes(ctx context.Context, req *gpb.NodesRequest) (*gpb.NodesReply, error) {
+	reply := &gpb.NodesReply{Nodes: make(map[string]*cpb.NodeInfo)}
+	for _, ticket := range req.Ticket {
+		if text, ok := s.text[ticket]; ok {
+			reply.Nodes[ticket] = &cpb.NodeInfo{Facts: map[string][]byte{facts.Text: []byte(text)}}
+		}
+	}
+	return reply, nil
+}
+
+func TestLSSizes(t *testing.T) {
+	ft := testTree("dir/a.go", "dir/b.go", "dir/sub/c.go")
+	xs := textService{text: map[string]string{
+		entryTicket("a.go"): strings.Repeat("a", 1000),
+		entryTicket("b.go"): strings.Repeat("b", 2000),
+	}}
+
+	tests := []struct {
+		c    lsCommand
+		want string
+	}{
+		{lsCommand{showSizes: true}, "-\tsub/\n1000\ta.go\n2000\tb.go\n3000\ttotal\n"},
+		{lsCommand{showSizes: true, human: true, filesOnly: true}, "1000\ta.go\n2.0K\tb.go\n2.9K\ttotal\n"},
+	}
+	for _, test := range tests {
+		got, err := runLSWithAPI(t, test.c, API{FileTreeService: ft, XRefService: xs}, "kythe://kythe?path=dir")
+		if err != nil {
+			t.Errorf("ls %+v: unexpected error: %v", test.c, err)
+		} else if got != test.want {
+			t.Errorf("ls %+v: got %q, want %q", test.c, got, test.want)
+		}
+	}
+}
+
+func TestLSShowPackage(t *testing.T) {
+	ft := testTree("dir/a.go",
+		"dir/data/x.txt",
+		"dir/lib/b.go", "dir/lib/a.go", "dir/lib/README",
+		"dir/pkg/z.go", "dir/pkg/doc.go", "dir/pkg/sub/c.go")
+
+	tests := []struct {
+		c    lsCommand
+		want string
+	}{
+		{lsCommand{showPackage: true}, "data/\nlib/\ta.go\npkg/\tdoc.go\na.go\n"},
+		{lsCommand{showPackage: true, dirsOnly: true, absolute: true},
+			"dir/data/\ndir/lib/\tdir/lib/a.go\ndir/pkg/\tdir/pkg/doc.go\n"},
+	}
+	for _, test := range tests {
+		got, err := runLS(t, test.c, ft, "kythe://kythe?path=dir")
+		if err != nil {
+			t.Errorf("ls %+v: unexpected error: %v", test.c, err)
+		} else if got != test.want {
+			t.Errorf("ls %+v: got %q, want %q", test.c, got, test.want)
+		}
+	}
+
+	if _, err := runLS(t, lsCommand{showPackage: true, recursive: true, traversal: "dfs"}, ft, "kythe://kythe?path=dir"); err == nil {
+		t.Error("ls --show_package --recursive: unexpectedly succeeded")
+	}
+}
+
+// importService is a fake xrefs.Service whose files import the given packages.
+type importService struct {
+	xrefs.Service
+	imports map[string][]string // :: file ticket → package tickets
+}
+
+func (s importService) Decorations(ctx context.Context, req *xpb.DecorationsRequest) (*xpb.DecorationsReply, error) {
+	pkgs, ok := s.imports[req.Location.Ticket]
+	if !ok {
+		return nil, xrefs.ErrDecorationsNotFound
+	}
+	reply := &xpb.DecorationsReply{Location: req.Location}
+	for _, pkg := range pkgs {
+		reply.Reference = append(reply.Reference,
+			&xpb.DecorationsReply_Reference{TargetTicket: pkg, Kind: edges.RefImports},
+			&xpb.DecorationsReply_Reference{TargetTicket: pkg + "#x", Kind: edges.Ref})
+	}
+	return reply, nil
+}
+
+func TestLSFollowImports(t *testing.T) {
+	ft := testTree("dir/a.go", "dir/b.go", "dir/README", "lib/c.go", "util/d.go")
+	pkg := func(corpus, path string) string {
+		uri := kytheuri.URI{Corpus: corpus, Path: path, Language: "go", Signature: "package"}
+		return uri.String()
+	}
+	xs := importService{imports: map[string][]string{
+		entryTicket("a.go"):           {pkg("kythe", "lib"), pkg("golang.org", "fmt")},
+		entryTicket("b.go"):           {pkg("kythe", "lib")},
+		"kythe://kythe?path=lib/c.go": {pkg("kythe", "util"), pkg("kythe", "dir")},
+	}}
+
+	tests := []struct {
+		c    lsCommand
+		want string
+	}{
+		{lsCommand{followImports: true, importDepth: 1}, "golang.org/fmt/\nkythe/lib/\n"},
+		{lsCommand{followImports: true, importDepth: 3}, "golang.org/fmt/\nkythe/lib/\nkythe/util/\n"},
+		{lsCommand{followImports: true, importDepth: 2, lsURIs: true},
+			"kythe://golang.org?path=fmt\nkythe://kythe?path=lib\nkythe://kythe?path=util\n"},
+	}
+	for _, test := range tests {
+		got, err := runLSWithAPI(t, test.c, API{FileTreeService: ft, XRefService: xs}, "kythe://kythe?path=dir")
+		if err != nil {
+			t.Errorf("ls %+v: unexpected error: %v", test.c, err)
+		} else if got != test.want {
+			t.Errorf("ls %+v: got %q, want %q", test.c, got, test.want)
+		}
+	}
+
+	for _, c := range []lsCommand{
+		{followImports: true, importDepth: 0},
+		{followImports: true, importDepth: 1, recursive: true, traversal: "dfs"},
+	} {
+		if _, err := runLSWithAPI(t, c, API{FileTreeService: ft, XRefService: xs}, "kythe://kythe?path=dir"); err == nil {
+			t.Errorf("ls %+v: unexpectedly succeeded", c)
+		}
+	}
+}
+
+// countingTree is a filetree service that counts the directory requests for
+// each path, and fails those for the broken path.
+type countingTree struct {
+	*filetree.Map
+	broken string
+
+	mu    sync.Mutex
+	calls map[string]int // :: path → number of requests
+}
+
+func (c *countingTree) Directory(ctx context.Context, req *ftpb.DirectoryRequest) (*ftpb.DirectoryReply, error) {
+	c.mu.Lock()
+	c.calls[req.Path]++
+	c.mu.Unlock()
+	if req.Path == c.broken {
+		return nil, errors.New("broken directory")
+	}
+	return c.Map.Directory(ctx, req)
+}
+
+func TestLSChildCounts(t *testing.T) {
+	ft := &countingTree{
+		Map:    testTree("dir/a.go", "dir/one/b.go", "dir/two/c.go", "dir/two/d.go", "dir/two/sub/e.go", "dir/bad/f.go"),
+		broken: "dir/bad",
+		calls:  make(map[string]int),
+	}
+
+	got, err := runLS(t, lsCommand{childCounts: true}, ft, "kythe://kythe?path=dir")
+	if err != nil {
+		t.Fatalf("ls --child_counts: unexpected error: %v", err)
+	} else if want := "one/\t1\ntwo/\t3\nbad/\t?\na.go\n"; got != want {
+		t.Errorf("ls --child_counts: got %q, want %q", got, want)
+	}
+
+	// In a batch, each subdirectory is looked up once however many listings
+	// include it.
+	defer func(r io.Reader) { in = r }(in)
+	in = strings.NewReader("kythe://kythe?path=dir\nkythe://kythe?path=dir\n")
+	ft.calls = make(map[string]int)
+	if _, err := runLS(t, lsCommand{childCounts: true, batch: true, dirsOnly: true}, ft); err != nil {
+		t.Fatalf("ls --child_counts --batch: unexpected error: %v", err)
+	}
+	want := map[string]int{"dir": 2, "dir/bad": 1, "dir/one": 1, "dir/two": 1}
+	if err := testutil.DeepEqual(want, ft.calls); err != nil {
+		t.Errorf("ls --child_counts --batch: directory requests: %v", err)
+	}
+
+	if _, err := runLS(t, lsCommand{childCounts: true, recursive: true, traversal: "dfs"}, ft, "kythe://kythe?path=dir"); err == nil {
+		t.Error("ls --child_counts --recursive: got no error, wanted one")
+	}
+}
+
+func TestLSPagingCursor(t *testing.T) {
+	ft := testTree("dir/a.go", "dir/b.go", "dir/c.go", "dir/d/x.go", "dir/e.go")
+
+	// Each page is listed from the cursor of the one before it.  The last page
+	// is full, but has no cursor since nothing follows it.
+	tests := []struct {
+		after      string
+		want, next string
+	}{
+		{"", "a.go\nb.go\n", "b.go"},
+		{"b.go", "d/\nc.go\n", "d"},
+		{"d", "e.go\n", ""},
+	}
+	for _, test := range tests {
+		c := lsCommand{pageAfter: test.after, pageLimit: 2}
+		got, err := runLS(t, c, ft, "kythe://kythe?path=dir")
+		if err != nil {
+			t.Errorf("ls --after %q --limit 2: unexpected error: %v", test.after, err)
+			continue
+		}
+		want := test.want
+		if test.next != "" {
+			want += fmt.Sprintf("Next page cursor: --after %q\n", test.next)
+		}
+		if got != want {
+			t.Errorf("ls --after %q --limit 2: got %q, want %q", test.after, got, want)
+		}
+
+		c.format = entriesJSON
+		got, err = runLS(t, c, ft, "kythe://kythe?path=dir")
+		if err != nil {
+			t.Errorf("ls --format %s --after %q --limit 2: unexpected error: %v", entriesJSON, test.after, err)
+			continue
+		}
+		var listing struct {
+			Next *string `json:"next"`
+		}
+		if err := json.Unmarshal([]byte(got), &listing); err != nil {
+			t.Errorf("ls --format %s --after %q --limit 2: invalid JSON %q: %v", entriesJSON, test.after, got, err)
+		} else if next := listing.Next; (next == nil) != (test.next == "") || (next != nil && *next != test.next) {
+			t.Errorf("ls --format %s --after %q --limit 2: got %q, want next %q", entriesJSON, test.after, got, test.next)
+		}
+	}
+
+	DisplayJSON = true
+	defer func() { DisplayJSON = false }()
+	for _, test := range tests {
+		got, err := runLS(t, lsCommand{pageAfter: test.after, pageLimit: 2}, ft, "kythe://kythe?path=dir")
+		if err != nil {
+			t.Errorf("ls --json --after %q --limit 2: unexpected error: %v", test.after, err)
+			continue
+		}
+		var dir struct {
+			Next *string `json:"next"`
+		}
+		if err := json.Unmarshal([]byte(got), &dir); err != nil {
+			t.Errorf("ls --json --after %q --limit 2: invalid JSON %q: %v", test.after, got, err)
+		} else if next := dir.Next; (next == nil) != (test.next == "") || (next != nil && *next != test.next) {
+			t.Errorf("ls --json --after %q --limit 2: got %q, want next %q", test.after, got, test.next)
+		}
+	}
+}
+
+func TestLSOnlyCount(t *testing.T) {
+	ft := testTree("dir/a.go", "dir/b.go", "dir/sub/c.go", "dir/sub/deeper/d.go")
+
+	tests := []struct {
+		c    lsCommand
+		want string
+	}{
+		{lsCommand{onlyCount: true}, "3\n"},
+		{lsCommand{onlyCount: true, filesOnly: true}, "2\n"},
+		{lsCommand{onlyCount: true, dirsOnly: true}, "1\n"},
+		{lsCommand{onlyCount: true, pageLimit: 2}, "2\n"},
+		{lsCommand{onlyCount: true, recursive: true, traversal: "dfs"}, "6\n"},
+		{lsCommand{onlyCount: true, recursive: true, traversal: "bfs", filesOnly: true}, "4\n"},
+	}
+	for _, test := range tests {
+		got, err := runLS(t, test.c, ft, "kythe://kythe?path=dir")
+		if err != nil {
+			t.Errorf("ls %+v: unexpected error: %v", test.c, err)
+		} else if got != test.want {
+			t.Errorf("ls %+v: got %q, want %q", test.c, got, test.want)
+		}
+	}
+
+	DisplayJSON = true
+	defer func() { DisplayJSON = false }()
+	got, err := runLS(t, lsCommand{onlyCount: true, recursive: true, traversal: "dfs"}, ft, "kythe://kythe?path=dir")
+	if err != nil {
+		t.Fatalf("ls --only_count --recursive --json: unexpected error: %v", err)
+	}
+	var counts map[string]int
+	if err := json.Unmarshal([]byte(got), &counts); err != nil {
+		t.Fatalf("ls --only_count --recursive --json: invalid output %q: %v", got, err)
+	}
+	if err := testutil.DeepEqual(map[string]int{"directories": 2, "files": 4}, counts); err != nil {
+		t.Errorf("ls --only_count --recursive --json: %v", err)
+	}
+}
+
+func TestLSEntriesJSON(t *testing.T) {
+	ft := testTree("dir/b.go", "dir/a/x.go", "dir/c.go")
+
+	got, err := runLS(t, lsCommand{format: entriesJSON}, ft, "kythe://kythe?path=dir")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	const want = `{"entries":[` +
+		`{"name":"a","uri":"kythe://kythe?path=dir/a","kind":"directory"},` +
+		`{"name":"b.go","uri":"kythe://kythe?path=dir/b.go","kind":"file"},` +
+		`{"name":"c.go","uri":"kythe://kythe?path=dir/c.go","kind":"file"}]}` + "\n"
+	if got != want {
+		t.Errorf("ls --format entries-json:\n got %s\nwant %s", got, want)
+	}
+
+	got, err = runLS(t, lsCommand{format: entriesJSON, recursive: true, traversal: "bfs", filesOnly: true}, ft, "kythe://kythe?path=dir")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	const wantRecursive = `{"entries":[` +
+		`{"name":"a/x.go","uri":"kythe://kythe?path=dir/a/x.go","kind":"file"},` +
+		`{"name":"b.go","uri":"kythe://kythe?path=dir/b.go","kind":"file"},` +
+		`{"name":"c.go","uri":"kythe://kythe?path=dir/c.go","kind":"file"}]}` + "\n"
+	if got != wantRecursive {
+		t.Errorf("ls --format entries-json --recursive --files:\n got %s\nwant %s", got, wantRecursive)
+	}
+
+	got, err = runLS(t, lsCommand{format: entriesJSON}, ft, "kythe://kythe?path=empty")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	} else if want := `{"entries":[]}` + "\n"; got != want {
+		t.Errorf("ls --format entries-json of an empty directory: got %q, want %q", got, want)
+	}
+
+	if _, err := runLS(t, lsCommand{format: "xml"}, ft, "kythe://kythe?path=dir"); err == nil {
+		t.Error("ls --format xml: got no error, wanted one")
+	}
+}
+
+func TestLSEvents(t *testing.T) {
+	ft := testTree("dir/a.go", "dir/sub/b.go", "dir/sub/deeper/c.go", "dir/z.go")
+	event := func(kind, path string) string {
+		uri := kytheuri.URI{Corpus: "kythe", Path: path}
+		return `{"event":"` + kind + `","uri":"` + uri.String() + `"}` + "\n"
+	}
+
+	tests := []struct {
+		traversal string
+		want      []string
+	}{
+		{"dfs", []string{
+			event("enter_dir", "dir"),
+			event("file", "dir/a.go"),
+			event("enter_dir", "dir/sub"),
+			event("file", "dir/sub/b.go"),
+			event("enter_dir", "dir/sub/deeper"),
+			event("file", "dir/sub/deeper/c.go"),
+			event("exit_dir", "dir/sub/deeper"),
+			event("exit_dir", "dir/sub"),
+			event("file", "dir/z.go"),
+			event("exit_dir", "dir"),
+		}},
+		{"bfs", []string{
+			event("enter_dir", "dir"),
+			event("file", "dir/a.go"),
+			event("file", "dir/z.go"),
+			event("exit_dir", "dir"),
+			event("enter_dir", "dir/sub"),
+			event("file", "dir/sub/b.go"),
+			event("exit_dir", "dir/sub"),
+			event("enter_dir", "dir/sub/deeper"),
+			event("file", "dir/sub/deeper/c.go"),
+			event("exit_dir", "dir/sub/deeper"),
+		}},
+	}
+	for _, test := range tests {
+		c := lsCommand{recursive: true, traversal: test.traversal, format: eventsNDJSON}
+		got, err := runLS(t, c, ft, "kythe://kythe?path=dir")
+		if err != nil {
+			t.Errorf("ls %+v: unexpected error: %v", c, err)
+		} else if want := strings.Join(test.want, ""); got != want {
+			t.Errorf("ls %+v:\n got %s\nwant %s", c, got, want)
+		}
+	}
+
+	if _, err := runLS(t, lsCommand{format: eventsNDJSON}, ft, "kythe://kythe?path=dir"); err == nil {
+		t.Error("ls --format ndjson-events without --recursive: got no error, wanted one")
+	}
+}
+
+func TestLSHideEmpty(t *testing.T) {
+	ft := testTree("dir/a/b/x.go", "dir/a/y.go", "dir/c/d/z.go", "dir/e/w.go", "dir/v.go")
+	// Empty the directories dir/c/d and dir/e, leaving dir/c with no files
+	// anywhere below it.
+	for _, path := range []string{"dir/c/d/z.go", "dir/e/w.go"} {
+		ft.M["kythe"][""][filetree.CleanDirPath(filepath.Dir(path))].File = nil
+	}
+
+	tests := []struct {
+		c    lsCommand
+		want []string
+	}{{
+		lsCommand{recursive: true, traversal: "dfs"},
+		[]string{"a/", "a/b/", "a/b/x.go", "a/y.go", "c/", "c/d/", "e/", "v.go"},
+	}, {
+		lsCommand{recursive: true, traversal: "dfs", hideEmpty: true},
+		[]string{"a/", "a/b/", "a/b/x.go", "a/y.go", "v.go"},
+	}, {
+		lsCommand{recursive: true, traversal: "bfs", hideEmpty: true},
+		[]string{"a/", "v.go", "a/b/", "a/y.go", "a/b/x.go"},
+	}}
+	for _, test := range tests {
+		got, err := runLS(t, test.c, ft, "kythe://kythe?path=dir")
+		if err != nil {
+			t.Errorf("ls %+v: unexpected error: %v", test.c, err)
+		} else if want := strings.Join(test.want, "\n") + "\n"; got != want {
+			t.Errorf("ls %+v: got:\n%s\nwant:\n%s", test.c, got, want)
+		}
+	}
+
+	got, err := runLS(t, lsCommand{recursive: true, traversal: "dfs", hideEmpty: true, onlyCount: true}, ft, "kythe://kythe?path=dir")
+	if err != nil {
+		t.Errorf("ls --hide_empty --only_count: unexpected error: %v", err)
+	} else if want := "5\n"; got != want {
+		t.Errorf("ls --hide_empty --only_count: got %q, want %q", got, want)
+	}
+
+	if _, err := runLS(t, lsCommand{hideEmpty: true}, ft, "kythe://kythe?path=dir"); err == nil {
+		t.Error("ls --hide_empty without --recursive: got no error, wanted one")
+	}
+}
+
+func TestLSTree(t *testing.T) {
+	ft := testTree("dir/a/b/x.go", "dir/a/y.go", "dir/c.go", "dir/d/z.go", "dir/e.go", "dir/f/w.go")
+	// Empty the directory dir/f.
+	ft.M["kythe"][""]["dir/f"].File = nil
+
+	tests := []struct {
+		c    lsCommand
+		want []string
+	}{{
+		lsCommand{recursive: true, traversal: "dfs", tree: true},
+		[]string{
+			"dir/",
+			"├── a/",
+			"│   ├── b/",
+			"│   │   └── x.go",
+			"│   └── y.go",
+			"├── d/",
+			"│   └── z.go",
+			"├── f/",
+			"├── c.go",
+			"└── e.go",
+			"",
+			"4 directories, 5 files",
+		},
+	}, {
+		lsCommand{recursive: true, traversal: "dfs", tree: true, ascii: true, dirsOnly: true},
+		[]string{
+			"dir/",
+			"|-- a/",
+			"|   `-- b/",
+			"|-- d/",
+			"`-- f/",
+			"",
+			"4 directories, 0 files",
+		},
+	}, {
+		lsCommand{recursive: true, traversal: "bfs", tree: true, ascii: true, filesOnly: true},
+		[]string{
+			"dir/",
+			"|-- a/",
+			"|   |-- b/",
+			"|   |   `-- x.go",
+			"|   `-- y.go",
+			"|-- d/",
+			"|   `-- z.go",
+			"|-- c.go",
+			"`-- e.go",
+			"",
+			"3 directories, 5 files",
+		},
+	}}
+	for _, test := range tests {
+		got, err := runLS(t, test.c, ft, "kythe://kythe?path=dir")
+		if err != nil {
+			t.Errorf("ls %+v: unexpected error: %v", test.c, err)
+		} else if want := strings.Join(test.want, "\n") + "\n"; got != want {
+			t.Errorf("ls %+v: got:\n%s\nwant:\n%s", test.c, got, want)
+		}
+	}
+
+	for _, c := range []lsCommand{
+		{tree: true},
+		{recursive: true, tree: true, lsURIs: true},
+		{recursive: true, ascii: true},
+	} {
+		if _, err := runLS(t, c, ft, "kythe://kythe?path=dir"); err == nil {
+			t.Errorf("ls %+v: got no error, wanted one", c)
+		}
+	}
+}
+
+func TestLSRootsJSON(t *testing.T) {
+	ft := filetree.NewMap()
+	for _, file := range []*spb.VName{
+		{Corpus: "kythe", Root: "gen", Path: "a.go"},
+		{Corpus: "other", Path: "b.go"},
+		{Corpus: "kythe", Path: "c.go"},
+		{Corpus: "kythe", Root: "bazel-out", Path: "d.go"},
+		{Corpus: "another", Root: "src", Path: "e.go"},
+	} {
+		ft.AddFile(file)
+	}
+
+	got, err := runLS(t, lsCommand{format: rootsJSON}, ft)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	const want = `[` +
+		`{"corpus":"another","root":"src"},` +
+		`{"corpus":"kythe","root":""},` +
+		`{"corpus":"kythe","root":"bazel-out"},` +
+		`{"corpus":"kythe","root":"gen"},` +
+		`{"corpus":"other","root":""}]` + "\n"
+	if got != want {
+		t.Errorf("ls --format roots-json:\n got %s\nwant %s", got, want)
+	}
+
+	if got, err := runLS(t, lsCommand{format: rootsJSON}, filetree.NewMap()); err != nil {
+		t.Errorf("ls --format roots-json with no corpora: unexpected error: %v", err)
+	} else if want := "[]\n"; got != want {
+		t.Errorf("ls --format roots-json with no corpora: got %q, want %q", got, want)
+	}
+
+	if _, err := runLS(t, lsCommand{format: rootsJSON}, ft, "kythe://kythe?path=dir"); err == nil {
+		t.Error("ls --format roots-json with a directory: got no error, wanted one")
+	}
+	if _, err := runLS(t, lsCommand{format: entriesJSON}, ft); err == nil {
+		t.Error("ls --format entries-json without a directory: got no error, wanted one")
+	}
+}
+
+// staleTree is a filetree service that reports additional corpus roots, which
+// have no contents, and that fails to read the directories of a broken root.
+type staleTree struct {
+	*filetree.Map
+	stale  map[string][]string // :: corpus → roots
+	broken string
+}
+
+func (s staleTree) CorpusRoots(ctx context.Context, req *ftpb.CorpusRootsRequest) (*ftpb.CorpusRootsReply, error) {
+	reply, err := s.Map.CorpusRoots(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	for corpus, roots := range s.stale {
+		reply.Corpus = append(reply.Corpus, &ftpb.CorpusRootsReply_Corpus{Name: corpus, Root: roots})
+	}
+	return reply, nil
+}
+
+func (s staleTree) Directory(ctx context.Context, req *ftpb.DirectoryRequest) (*ftpb.DirectoryReply, error) {
+	if req.Root == s.broken {
+		return nil, errors.New("broken root")
+	}
+	return s.Map.Directory(ctx, req)
+}
+
+func TestLSNonEmpty(t *testing.T) {
+	ft := staleTree{
+		Map: filetree.NewMap(),
+		stale: map[string][]string{
+			"kythe": {"stale"},
+			"gone":  {"", "old"},
+			"flaky": {"broken"},
+		},
+		broken: "broken",
+	}
+	ft.AddFile(&spb.VName{Corpus: "kythe", Path: "a.go"})
+	ft.AddFile(&spb.VName{Corpus: "kythe", Root: "gen", Path: "sub/b.go"})
+
+	tests := []struct {
+		c    lsCommand
+		want string
+	}{
+		{lsCommand{format: rootsJSON}, `[` +
+			`{"corpus":"flaky","root":"broken"},` +
+			`{"corpus":"gone","root":""},` +
+			`{"corpus":"gone","root":"old"},` +
+			`{"corpus":"kythe","root":""},` +
+			`{"corpus":"kythe","root":"gen"},` +
+			`{"corpus":"kythe","root":"stale"}]` + "\n"},
+		{lsCommand{format: rootsJSON, nonEmpty: true}, `[` +
+			`{"corpus":"flaky","root":"broken"},` +
+			`{"corpus":"kythe","root":""},` +
+			`{"corpus":"kythe","root":"gen"}]` + "\n"},
+	}
+	for _, test := range tests {
+		got, err := runLS(t, test.c, ft)
+		if err != nil {
+			t.Errorf("ls %+v: unexpected error: %v", test.c, err)
+		} else if got != test.want {
+			t.Errorf("ls %+v:\n got %s\nwant %s", test.c, got, test.want)
+		}
+	}
+
+	if _, err := runLS(t, lsCommand{nonEmpty: true}, ft, "kythe://kythe?path=dir"); err == nil {
+		t.Error("ls --non_empty with a directory: got no error, wanted one")
+	}
+}
+
+// malformedTree is a filetree service whose directory replies include an
+// additional file with a malformed ticket.
+type malformedTree struct {
+	*filetree.Map
+	ticket string
+}
+
+func (m malformedTree) Directory(ctx context.Context, req *ftpb.DirectoryRequest) (*ftpb.DirectoryReply, error) {
+	reply, err := m.Map.Directory(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	return &ftpb.DirectoryReply{
+		Subdirectory: reply.Subdirectory,
+		File:         append(append([]string(nil), reply.File...), m.ticket),
+	}, nil
+}
+
+// cancelingTree is a filetree service that cancels a context once it has
+// answered a directory request.
+type cancelingTree struct {
+	*filetree.Map
+	cancel context.CancelFunc
+}
+
+func (c cancelingTree) Directory(ctx context.Context, req *ftpb.DirectoryRequest) (*ftpb.DirectoryReply, error) {
+	defer c.cancel()
+	return c.Map.Directory(ctx, req)
+}
+
+func TestLSRecursiveCanceled(t *testing.T) {
+	ft := testTree("dir/a.go", "dir/sub/b.go", "dir/sub/deeper/c.go", "dir/z.go")
+
+	tests := []struct {
+		c    lsCommand
+		want string
+	}{
+		{lsCommand{recursive: true, traversal: "dfs"}, "a.go\nsub/\n"},
+		{lsCommand{recursive: true, traversal: "bfs"}, "a.go\nsub/\nz.go\n"},
+		{lsCommand{recursive: true, traversal: "dfs", onlyCount: true}, "2\n"},
+		{lsCommand{recursive: true, traversal: "dfs", tree: true, ascii: true},
+			"dir/\n|-- sub/\n`-- a.go\n\n1 directory, 1 file\n"},
+	}
+	for _, test := range tests {
+		ctx, cancel := context.WithCancel(context.Background())
+		got, err := runLSWithContext(ctx, t, test.c, API{FileTreeService: cancelingTree{ft, cancel}}, "kythe://kythe?path=dir")
+		if err != context.Canceled {
+			t.Errorf("ls %+v: got error %v, want %v", test.c, err, context.Canceled)
+		}
+		if got != test.want {
+			t.Errorf("ls %+v: got %q, want %q", test.c, got, test.want)
+		}
+	}
+}
+
+func TestLSEmitEntries(t *testing.T) {
+	ft := testTree("dir/a.go", "dir/sub/b.go")
+	got, err := runLS(t, lsCommand{emitEntries: true}, ft, "kythe://kythe?path=dir")
+	if err != nil {
+		t.Fatalf("ls --emit_entries: unexpected error: %v", err)
+	}
+
+	var entries []*spb.Entry
+	rd := delimited.NewReader(strings.NewReader(got))
+	for {
+		var entry spb.Entry
+		if err := rd.NextProto(&entry); err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatalf("Reading emitted entries: %v", err)
+		}
+		entries = append(entries, &entry)
+	}
+
+	dir := &spb.VName{Corpus: "kythe", Path: "dir"}
+	file := &spb.VName{Corpus: "kythe", Path: "dir/a.go"}
+	want := []*spb.Entry{
+		{Source: &spb.VName{Corpus: "kythe", Path: "dir/sub"}, EdgeKind: edges.ChildOf, Target: dir, FactName: "/"},
+		{Source: file, FactName: facts.NodeKind, FactValue: []byte(nodes.File)},
+		{Source: file, EdgeKind: edges.ChildOf, Target: dir, FactName: "/"},
+	}
+	if err := testutil.DeepEqual(want, entries); err != nil {
+		t.Errorf("ls --emit_entries: %v", err)
+	}
+
+	if _, err := runLS(t, lsCommand{emitEntries: true, recursive: true, traversal: "dfs"}, ft, "kythe://kythe?path=dir"); err == nil {
+		t.Error("ls --emit_entries --recursive: unexpectedly succeeded")
+	}
+}
+
+func TestLSCheck(t *testing.T) {
+	ft := testTree("dir/a.go", "dir/sub/b.go")
+
+	if got, err := runLS(t, lsCommand{check: true}, ft, "kythe://kythe?path=dir"); err != nil {
+		t.Errorf("ls --check of a well-formed directory: unexpected error: %v", err)
+	} else if got != "" {
+		t.Errorf("ls --check of a well-formed directory: got output %q, want none", got)
+	}
+
+	const bad = "kythe://kythe?path=dir/c.go?bogus"
+	got, err := runLS(t, lsCommand{check: true}, malformedTree{ft, bad}, "kythe://kythe?path=dir")
+	if err == nil {
+		t.Fatal("ls --check of a malformed directory: got no error, wanted one")
+	} else if got != "" {
+		t.Errorf("ls --check of a malformed directory: got output %q, want none", got)
+	}
+	if msg := err.Error(); !strings.Contains(msg, "1 of 3 entries") || !strings.Contains(msg, bad) {
+		t.Errorf("ls --check of a malformed directory: got error %q, want one naming %q", msg, bad)
+	}
+
+	if _, err := runLS(t, lsCommand{check: true, recursive: true, traversal: "dfs"}, ft, "kythe://kythe?path=dir"); err == nil {
+		t.Error("ls --check --recursive: got no error, wanted one")
+	}
+
+	// In a JSON batch, each malformed directory is reported in its listing.
+	defer func(r io.Reader) { in = r }(in)
+	in = strings.NewReader("kythe://kythe?path=dir\n")
+	DisplayJSON = true
+	got, err = runLS(t, lsCommand{batch: true, check: true}, malformedTree{ft, "kythe://kythe?badparam"})
+	DisplayJSON = false
+	if err == nil {
+		t.Error("ls --batch --json --check of a malformed directory: got no error, wanted one")
+	}
+	var listings []struct {
+		Directory json.RawMessage
+		Error     string
+	}
+	if err := json.Unmarshal([]byte(got), &listings); err != nil {
+		t.Fatalf("ls --batch --json --check: invalid output %q: %v", got, err)
+	} else if len(listings) != 1 || listings[0].Directory != nil || !strings.Contains(listings[0].Error, "badparam") {
+		t.Errorf("ls --batch --json --check of a malformed directory: got %q, want an error naming the entry", got)
+	}
+
+	// Paging parses each entry, which would stop at the first malformed one
+	// rather than reporting all of them.
+	for _, c := range []lsCommand{
+		{check: true, pageAfter: "a.go"},
+		{check: true, pageBefore: "sub"},
+		{check: true, pageLimit: 1},
+	} {
+		if _, err := runLS(t, c, malformedTree{ft, bad}, "kythe://kythe?path=dir"); err == nil {
+			t.Errorf("ls --check with paging %+v: got no error, wanted one", c)
+		} else if msg := err.Error(); !strings.Contains(msg, "--check cannot be used") {
+			t.Errorf("ls --check with paging: got error %q, want a usage error", msg)
+		}
+	}
+}
+
+func TestLSRaw(t *testing.T) {
+	const bad = "not a kythe uri"
+	ft := malformedTree{testTree("dir/a.go", "dir/sub/b.go"), bad}
+
+	got, err := runLS(t, lsCommand{raw: true}, ft, "kythe://kythe?path=dir")
+	if err != nil {
+		t.Fatalf("ls --raw: unexpected error: %v", err)
+	}
+	if want := "kythe://kythe?path=dir/sub\nkythe://kythe?path=dir/a.go\n" + bad + "\n"; got != want {
+		t.Errorf("ls --raw: got %q, want %q", got, want)
+	}
+
+	if _, err := runLS(t, lsCommand{}, ft, "kythe://kythe?path=dir"); err == nil {
+		t.Error("ls of a directory with a malformed ticket: got no error, wanted one")
+	}
+
+	if _, err := runLS(t, lsCommand{raw: true, recursive: true, traversal: "dfs"}, ft, "kythe://kythe?path=dir"); err == nil {
+		t.Error("ls --raw --recursive: got no error, wanted one")
+	}
+}
+
+func TestLSByLang(t *testing.T) {
+	ft := filetree.NewMap()
+	for _, file := range []*spb.VName{
+		{Corpus: "kythe", Path: "dir/a.go", Language: "go"},
+		{Corpus: "kythe", Path: "dir/b.proto", Language: "protobuf"},
+		{Corpus: "kythe", Path: "dir/c.txt"},
+		{Corpus: "kythe", Path: "dir/sub/d.go", Language: "go"},
+		{Corpus: "kythe", Path: "dir/sub/e.proto", Language: "protobuf"},
+		{Corpus: "kythe", Path: "dir/sub/deeper/f.go", Language: "go"},
+		{Corpus: "kythe", Path: "dir/sub/deeper/g.cc", Language: "c++"},
+	} {
+		ft.AddFile(file)
+	}
+
+	got, err := runLS(t, lsCommand{byLang: true, recursive: true, traversal: "dfs"}, ft, "kythe://kythe?path=dir")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	} else if want := "go: 3\nprotobuf: 2\nc++: 1\nunknown: 1\n"; got != want {
+		t.Errorf("ls --by_lang --recursive: got %q, want %q", got, want)
+	}
+
+	got, err = runLS(t, lsCommand{byLang: true}, ft, "kythe://kythe?path=dir")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	} else if want := "go: 1\nprotobuf: 1\nunknown: 1\n"; got != want {
+		t.Errorf("ls --by_lang: got %q, want %q", got, want)
+	}
+
+	DisplayJSON = true
+	defer func() { DisplayJSON = false }()
+	got, err = runLS(t, lsCommand{byLang: true, recursive: true, traversal: "bfs"}, ft, "kythe://kythe?path=dir")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	var counts map[string]int
+	if err := json.Unmarshal([]byte(got), &counts); err != nil {
+		t.Fatalf("ls --by_lang --recursive --json: invalid output %q: %v", got, err)
+	}
+	if err := testutil.DeepEqual(map[string]int{"go": 3, "protobuf": 2, "c++": 1, "unknown": 1}, counts); err != nil {
+		t.Errorf("ls --by_lang --recursive --json: %v", err)
+	}
+
+	if _, err := runLS(t, lsCommand{byLang: true, dirsOnly: true}, ft, "kythe://kythe?path=dir"); err == nil {
+		t.Error("ls --by_lang --dirs: got no error, wanted one")
+	}
+}
+
+func TestLSExclude(t *testing.T) {
+	ft := testTree("dir/a.go", "dir/a_test.go", "dir/b.go", "dir/b_test.go", "dir/sub/c.go", "dir/sub/c_test.go", "dir/testdata/d.go")
+
+	tests := []struct {
+		c    lsCommand
+		want []string
+	}{{
+		lsCommand{excludes: globList{"*_test.go"}},
+		[]string{"sub/", "testdata/", "a.go", "b.go"},
+	}, {
+		lsCommand{excludes: globList{"*_test.go", "testdata"}},
+		[]string{"sub/", "a.go", "b.go"},
+	}, {
+		lsCommand{excludes: globList{"*_test.go"}, filesOnly: true},
+		[]string{"a.go", "b.go"},
+	}, {
+		lsCommand{excludes: globList{"*_test.go", "testdata"}, recursive: true, traversal: "dfs"},
+		[]string{"a.go", "b.go", "sub/", "sub/c.go"},
+	}, {
+		lsCommand{excludes: globList{"s*"}, recursive: true, traversal: "dfs", dirsOnly: true},
+		[]string{"testdata/"},
+	}}
+	for _, test := range tests {
+		got, err := runLS(t, test.c, ft, "kythe://kythe?path=dir")
+		if err != nil {
+			t.Errorf("ls %+v: unexpected error: %v", test.c, err)
+		} else if want := strings.Join(test.want, "\n") + "\n"; got != want {
+			t.Errorf("ls %+v: got:\n%s\nwant:\n%s", test.c, got, want)
+		}
+	}
+
+	if _, err := runLS(t, lsCommand{excludes: globList{"[a-"}}, ft, "kythe://kythe?path=dir"); err == nil {
+		t.Error("ls --exclude with an invalid pattern: got no error, wanted one")
+	}
+}